@@ -6,7 +6,6 @@ import (
 	"log"
 	"net"
 	"os"
-	"time"
 
 	"github.com/spance/suft/protocol"
 )
@@ -55,7 +54,7 @@ func main() {
 				log.Printf("connected to %s for %s", suConn.RemoteAddr(), local.RemoteAddr())
 				go duplexPipe(suConn, local)
 			} else {
-				safeClose(suConn)
+				safeClose(local)
 			}
 		}
 	} else {
@@ -94,7 +93,8 @@ func safeClose(c io.Closer) {
 
 func duplexPipe(s *suft.Conn, t net.Conn) {
 	const BUF_SIZE = 1 << 20
-	t.(*net.TCPConn).SetNoDelay(true)
+	tcp := t.(*net.TCPConn)
+	tcp.SetNoDelay(true)
 	defer t.Close()
 	defer s.Close()
 
@@ -102,17 +102,18 @@ func duplexPipe(s *suft.Conn, t net.Conn) {
 	go func() {
 		buf := make([]byte, BUF_SIZE)
 		io.CopyBuffer(s, t, buf)
+		// pass the EOF to suft peer
+		s.CloseWrite()
 		wait <- 1
 	}()
 	go func() {
 		buf := make([]byte, BUF_SIZE)
 		io.CopyBuffer(t, s, buf)
+		// pass the EOF to tcp peer
+		tcp.CloseWrite()
 		wait <- 1
 	}()
-	// one channel closed
+	// both directions were finished
+	<-wait
 	<-wait
-	select {
-	case <-wait: // second
-	case <-time.After(10e9):
-	}
 }
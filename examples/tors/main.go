@@ -128,11 +128,13 @@ func sessionHandle(conn net.Conn) {
 		// conn -> cmd.stdin
 		n, e := io.Copy(stdin, conn)
 		e = consumeClosedError(e)
+		stdin.Close()
 		log.Println("net/Rx", n, e)
 	}()
 	go func() {
 		// cmd.stdout -> conn
 		n, e := io.Copy(conn, stdout)
+		closeWrite(conn)
 		log.Println("net/Tx", n, e)
 	}()
 	// cmd.stderr -> current.stderr
@@ -154,8 +156,9 @@ func connect(addr string, args []string) {
 	go func() {
 		// stdin -> conn
 		n, e := io.Copy(conn, stdin)
+		// pass the EOF of stdin to peer
+		closeWrite(conn)
 		log.Println("net/Tx", n, e)
-		done <- 1
 	}()
 	go func() {
 		// conn -> stdout
@@ -163,9 +166,18 @@ func connect(addr string, args []string) {
 		log.Println("net/Rx", n, e)
 		done <- 2
 	}()
+	// finished while the peer has sent all
 	<-done
 }
 
+func closeWrite(conn net.Conn) {
+	if cw, y := conn.(interface {
+		CloseWrite() error
+	}); y {
+		cw.CloseWrite()
+	}
+}
+
 func isTemporaryError(err error) bool {
 	if err != nil {
 		if ne, y := err.(net.Error); y {
@@ -0,0 +1,180 @@
+package suft
+
+import (
+	"fmt"
+	"hash/maphash"
+	"log"
+	"net"
+	"sync"
+)
+
+// Admission control of incoming connections
+//
+// before cookie: Deny/Allow CIDR lists and SYN rate of source IP.
+// after cookie: AcceptFilter, the address has been proven.
+// accepting: MaxConns and MaxConnsPerIP.
+// The rejected peers get a RESET, and the SYN exceeding rate is dropped
+// silently because answering the flood is what the limit prevents.
+// The SYN rate is checked before the cookie, so the buckets are a fixed
+// array hashed by the source IP with a random seed, the spoofed sources
+// couldn't grow it, and only share a bucket by chance.
+type admission struct {
+	allow         []*net.IPNet
+	deny          []*net.IPNet
+	filter        func(*net.UDPAddr) bool
+	maxConns      int
+	maxConnsPerIP int
+	// counters, in Endpoint.mlock
+	inbound int
+	ipConns map[string]int
+	// syn rate limiter
+	synRate int64
+	rlock   sync.Mutex
+	buckets []synBucket
+	seed    maphash.Seed
+}
+
+const _SYN_BUCKETS = 4096
+
+type synBucket struct {
+	tokens int64 // in micro-tokens
+	last   int64
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad CIDR %q: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newAdmission(p *Params) (*admission, error) {
+	allow, err := parseCIDRs(p.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(p.Deny)
+	if err != nil {
+		return nil, err
+	}
+	a := &admission{
+		allow:         allow,
+		deny:          deny,
+		filter:        p.AcceptFilter,
+		maxConns:      p.MaxConns,
+		maxConnsPerIP: p.MaxConnsPerIP,
+		ipConns:       make(map[string]int),
+		synRate:       int64(p.SynRate),
+	}
+	if a.synRate > 0 {
+		a.buckets = make([]synBucket, _SYN_BUCKETS)
+		a.seed = maphash.MakeSeed()
+	}
+	return a, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if ua, y := addr.(*net.UDPAddr); y {
+		return ua.IP
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check the ACL by source IP
+func (a *admission) permitted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// token bucket per IP, allows SynRate SYNs per second
+func (a *admission) allowSyn(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if a.synRate <= 0 || ip == nil {
+		return true
+	}
+	var h maphash.Hash
+	h.SetSeed(a.seed)
+	h.Write(ip.To16())
+	now := Now()
+	full := a.synRate * 1e6
+	a.rlock.Lock()
+	defer a.rlock.Unlock()
+	b := &a.buckets[h.Sum64()%_SYN_BUCKETS]
+	if b.last == 0 || now-b.last >= 1e6 {
+		b.tokens = full
+	} else {
+		b.tokens = minI64(b.tokens+(now-b.last)*a.synRate, full)
+	}
+	b.last = now
+	if b.tokens < 1e6 {
+		return false
+	}
+	b.tokens -= 1e6
+	return true
+}
+
+func (a *admission) accepted(addr net.Addr) bool {
+	if a.filter == nil {
+		return true
+	}
+	if ua, y := addr.(*net.UDPAddr); y {
+		return a.filter(ua)
+	}
+	return true
+}
+
+// reserve a place of connection limits, must in Endpoint.mlock
+// return the key of IP to release it later.
+func (a *admission) reserve(addr net.Addr) (key string, ok bool) {
+	if a.maxConns > 0 && a.inbound >= a.maxConns {
+		return
+	}
+	if ip := addrIP(addr); ip != nil {
+		key = ip.String()
+		if a.maxConnsPerIP > 0 && a.ipConns[key] >= a.maxConnsPerIP {
+			return "", false
+		}
+		a.ipConns[key]++
+	}
+	a.inbound++
+	return key, true
+}
+
+// must in Endpoint.mlock
+func (a *admission) release(key string) {
+	a.inbound--
+	if key != "" {
+		if n := a.ipConns[key] - 1; n > 0 {
+			a.ipConns[key] = n
+		} else {
+			delete(a.ipConns, key)
+		}
+	}
+}
+
+func (e *Endpoint) refuse(shard int, addr net.Addr, id connID, reason string) {
+	e.resetPeer(shard, addr, id)
+	if debug >= 1 {
+		log.Println("refused", addr, reason)
+	}
+}
@@ -0,0 +1,55 @@
+package suft
+
+import (
+	"net"
+)
+
+// Batched I/O
+//
+// On linux, the packets are read and written by recvmmsg/sendmmsg, up to
+// _BATCH_SIZE packets per syscall. Other sockets fall back to one packet
+// per syscall.
+//
+// Furthermore the runs of equal sized packets are sent by GSO (UDP_SEGMENT)
+// and the coalesced packets are received by GRO (UDP_GRO) then split, if
+// the kernel supports them.
+const _BATCH_SIZE = 32
+
+// read one or more packets, each one is given to the handler
+// which takes the buffer.
+func (e *Endpoint) readPackets(shard int, handle func([]byte, net.Addr)) error {
+	if bio := e.bio[shard]; bio != nil {
+		return bio.readBatch(handle)
+	}
+	buf := bpool.Get(e.rsize)
+	n, addr, err := e.socks[shard].ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	handle(buf[:n], addr)
+	return nil
+}
+
+// write the items in as few syscalls as possible
+func (c *Conn) writeBatch(items []*qNode) {
+	var bufs = make([][]byte, 0, len(items))
+	for _, item := range items {
+		buf := c.prepareWrite(item)
+		if buf == nil { // shutdown
+			break
+		}
+		if frags := c.splitWrite(item); frags != nil {
+			bufs = append(bufs, frags...)
+		} else {
+			bufs = append(bufs, buf)
+		}
+	}
+	dest := c.RemoteAddr()
+	if len(bufs) > 1 && c.bio != nil && c.bio.canBatch(dest) {
+		// the rest will be written one by one if error
+		bufs = bufs[c.bio.writeBatch(bufs, dest):]
+	}
+	for _, buf := range bufs {
+		c.sock.WriteTo(buf, dest)
+	}
+}
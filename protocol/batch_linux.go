@@ -0,0 +1,249 @@
+package suft
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// max segments of one GSO send, see UDP_MAX_SEGMENTS
+	_GSO_MAX_SEGS = 64
+	_GSO_MAX_SIZE = 65000
+	// messages of GRO read, each buffer holds a coalesced datagram
+	_GRO_BATCH    = 8
+	_GRO_BUF_SIZE = 1 << 16
+)
+
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type batchIO struct {
+	pc    batchConn
+	rc    syscall.RawConn
+	v6    bool
+	gso   int32 // atomic, disabled if sending failed
+	gro   bool
+	rsize int            // buffer size of a packet
+	rmsgs []ipv4.Message // owned by the reader
+}
+
+func newBatchIO(pc net.PacketConn, rsize int) *batchIO {
+	uc, y := pc.(*net.UDPConn)
+	if !y {
+		return nil
+	}
+	b := &batchIO{rsize: rsize}
+	if la, y := uc.LocalAddr().(*net.UDPAddr); y && la.IP.To4() != nil {
+		b.pc = ipv4.NewPacketConn(uc)
+	} else {
+		b.pc, b.v6 = ipv6.NewPacketConn(uc), true
+	}
+	if rc, err := uc.SyscallConn(); err == nil {
+		b.rc = rc
+		rc.Control(func(fd uintptr) {
+			// getsockopt fails if the kernel doesn't know UDP_SEGMENT
+			if _, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT); err == nil {
+				b.gso = 1
+			}
+			b.gro = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+		})
+	}
+	if b.gro {
+		b.rmsgs = make([]ipv4.Message, _GRO_BATCH)
+		for i := range b.rmsgs {
+			b.rmsgs[i].Buffers = [][]byte{make([]byte, _GRO_BUF_SIZE)}
+			b.rmsgs[i].OOB = make([]byte, unix.CmsgSpace(4))
+		}
+	} else {
+		b.rmsgs = make([]ipv4.Message, _BATCH_SIZE)
+		for i := range b.rmsgs {
+			b.rmsgs[i].Buffers = make([][]byte, 1)
+		}
+	}
+	return b
+}
+
+// the ipv4 addr is always marshalled as AF_INET by x/net which can't be
+// written to an ipv6 socket, those are sent to the v4-mapped ipv6 addr by
+// sendmmsg of our own.
+func (b *batchIO) canBatch(addr net.Addr) bool {
+	ua, y := addr.(*net.UDPAddr)
+	return y && (!b.v6 || ua.IP.To4() == nil || b.rc != nil)
+}
+
+func (b *batchIO) mapped(addr net.Addr) bool {
+	ua, y := addr.(*net.UDPAddr)
+	return b.v6 && y && ua.IP.To4() != nil
+}
+
+func (b *batchIO) readBatch(handle func([]byte, net.Addr)) error {
+	msgs := b.rmsgs
+	if !b.gro {
+		for i := range msgs {
+			if msgs[i].Buffers[0] == nil {
+				msgs[i].Buffers[0] = bpool.Get(b.rsize)
+			}
+		}
+	}
+	n, err := b.pc.ReadBatch(msgs, 0)
+	for i := 0; i < n; i++ {
+		m := &msgs[i]
+		if !b.gro {
+			// the buffer was taken
+			handle(m.Buffers[0][:m.N], m.Addr)
+			m.Buffers[0] = nil
+			continue
+		}
+		// split the coalesced datagram, then the big buffer could be reused.
+		data, size := m.Buffers[0][:m.N], groSize(m.OOB[:m.NN])
+		if size <= 0 {
+			size = len(data)
+		}
+		for len(data) > 0 {
+			seg := minI(size, len(data))
+			if seg > b.rsize {
+				// not a packet, and never truncated into one
+				data = data[seg:]
+				continue
+			}
+			buf := bpool.Get(b.rsize)
+			handle(buf[:copy(buf, data[:seg])], m.Addr)
+			data = data[seg:]
+		}
+		m.OOB = m.OOB[:cap(m.OOB)]
+	}
+	return err
+}
+
+func groSize(oob []byte) int {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, c := range cmsgs {
+		if c.Header.Level == unix.IPPROTO_UDP && c.Header.Type == unix.UDP_GRO && len(c.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&c.Data[0])))
+		}
+	}
+	return 0
+}
+
+func gsoControl(size int) []byte {
+	b := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = uint16(size)
+	return b
+}
+
+// group the bufs into messages, a run of equal sized bufs (the last one
+// may be shorter) becomes one GSO message.
+func (b *batchIO) messages(bufs [][]byte, addr net.Addr) (msgs []ipv4.Message, segs []int) {
+	gso := atomic.LoadInt32(&b.gso) != 0
+	for i := 0; i < len(bufs); {
+		j, size, total := i+1, len(bufs[i]), len(bufs[i])
+		for gso && j < len(bufs) && j-i < _GSO_MAX_SEGS && total+len(bufs[j]) <= _GSO_MAX_SIZE &&
+			len(bufs[j]) <= size && len(bufs[j-1]) == size {
+			total += len(bufs[j])
+			j++
+		}
+		m := ipv4.Message{Buffers: bufs[i:j], Addr: addr}
+		if j-i > 1 {
+			m.OOB = gsoControl(size)
+		}
+		msgs, segs = append(msgs, m), append(segs, j-i)
+		i = j
+	}
+	return
+}
+
+// return the count of written bufs
+func (b *batchIO) writeBatch(bufs [][]byte, addr net.Addr) (sent int) {
+	msgs, segs := b.messages(bufs, addr)
+	for k := 0; k < len(msgs); {
+		var n int
+		var err error
+		if b.mapped(addr) {
+			n, err = b.writeMapped(msgs[k:], addr.(*net.UDPAddr))
+		} else {
+			n, err = b.pc.WriteBatch(msgs[k:], 0)
+		}
+		for _, s := range segs[k : k+n] {
+			sent += s
+		}
+		k += n
+		if err != nil {
+			// the device can't do segmentation offload
+			if k < len(msgs) && len(msgs[k].OOB) > 0 && isGSOError(err) {
+				atomic.StoreInt32(&b.gso, 0)
+			}
+			return
+		}
+	}
+	return
+}
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// sendmmsg the messages to the ipv4 peer via the ipv6 socket
+func (b *batchIO) writeMapped(msgs []ipv4.Message, ua *net.UDPAddr) (int, error) {
+	var sa unix.RawSockaddrInet6
+	sa.Family = unix.AF_INET6
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = byte(ua.Port>>8), byte(ua.Port)
+	copy(sa.Addr[:], ua.IP.To16())
+	hs := make([]mmsghdr, len(msgs))
+	for i := range msgs {
+		m, h := &msgs[i], &hs[i].hdr
+		iov := make([]unix.Iovec, len(m.Buffers))
+		for j, buf := range m.Buffers {
+			iov[j].Base = &buf[0]
+			iov[j].SetLen(len(buf))
+		}
+		h.Name = (*byte)(unsafe.Pointer(&sa))
+		h.Namelen = unix.SizeofSockaddrInet6
+		h.Iov = &iov[0]
+		h.SetIovlen(len(iov))
+		if len(m.OOB) > 0 {
+			h.Control = &m.OOB[0]
+			h.SetControllen(len(m.OOB))
+		}
+	}
+	var n int
+	var operr error
+	err := b.rc.Write(func(fd uintptr) bool {
+		r, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&hs[0])), uintptr(len(hs)), 0, 0, 0)
+		if errno == unix.EAGAIN {
+			return false
+		}
+		if errno != 0 {
+			operr = errno
+		} else {
+			n = int(r)
+		}
+		return true
+	})
+	if err == nil {
+		err = operr
+	}
+	return n, err
+}
+
+func isGSOError(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == unix.EIO || errno == unix.EINVAL)
+}
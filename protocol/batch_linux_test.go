@@ -0,0 +1,121 @@
+package suft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_batch_io(t *testing.T) {
+	serv, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 50, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 50})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+	assert(serv.bio[0] != nil && cli.bio[0] != nil, t, "batch unsupported")
+	t.Logf("gso=%d gro=%v", cli.bio[0].gso, serv.bio[0].gro)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		c, err := cli.Dial(serv.Addr().String())
+		if err == nil {
+			c.Write(data)
+			c.Close()
+		}
+	}()
+	c, err := serv.AcceptContext(ctxTimeout(t, 3*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	recv, err := io.ReadAll(c)
+	assert(err == nil && bytes.Equal(recv, data), t, "recv %d %v", len(recv), err)
+}
+
+func Test_batch_can(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 1}
+	b := &batchIO{}
+	assert(b.canBatch(v4) && b.canBatch(v6), t, "v4 socket")
+	b.v6 = true
+	assert(!b.canBatch(v4) && b.canBatch(v6), t, "v6 socket")
+	b.rc = &fakeRawConn{}
+	assert(b.canBatch(v4) && b.mapped(v4) && !b.mapped(v6), t, "v4-mapped")
+}
+
+type fakeRawConn struct{ syscall.RawConn }
+
+func Test_batch_mapped(t *testing.T) {
+	// the ipv4 peer of a dual-stack socket
+	serv, err := NewEndpoint(&Params{LocalAddr: "[::]:0", Bandwidth: 50, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 50})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+	assert(serv.bio[0] != nil && serv.bio[0].v6, t, "not v6 socket")
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	port := serv.Addr().(*net.UDPAddr).Port
+	go func() {
+		c, err := serv.AcceptContext(ctxTimeout(t, 3*time.Second))
+		if err == nil {
+			c.Write(data)
+			c.Close()
+		}
+	}()
+	c, err := cli.Dial(fmt.Sprintf("127.0.0.1:%d", port))
+	assert(err == nil, t, "dial %v", err)
+	recv, err := io.ReadAll(c)
+	assert(err == nil && bytes.Equal(recv, data), t, "recv %d %v", len(recv), err)
+}
+
+func Test_gso_messages(t *testing.T) {
+	b := &batchIO{gso: 1}
+	full, short := make([]byte, 1000), make([]byte, 300)
+	bufs := [][]byte{full, full, full, short, full, short, short}
+	msgs, segs := b.messages(bufs, nil)
+	assert(len(msgs) == 3, t, "msgs %d", len(msgs))
+	assert(segs[0] == 4 && segs[1] == 2 && segs[2] == 1, t, "segs %v", segs)
+	assert(len(msgs[0].OOB) > 0 && len(msgs[0].Buffers) == 4 && len(msgs[2].OOB) == 0, t, "gso msg")
+	msgs, _ = b.messages([][]byte{short, full}, nil)
+	assert(len(msgs) == 2 && len(msgs[0].OOB) == 0, t, "single")
+
+	// limited by count
+	bufs = make([][]byte, 100)
+	for i := range bufs {
+		bufs[i] = short
+	}
+	_, segs = b.messages(bufs, nil)
+	assert(len(segs) == 2 && segs[0] == _GSO_MAX_SEGS, t, "segs %v", segs)
+	// limited by size
+	for i := range bufs {
+		bufs[i] = make([]byte, 1400)
+	}
+	_, segs = b.messages(bufs, nil)
+	assert(len(segs) == 3 && segs[0] == _GSO_MAX_SIZE/1400, t, "segs %v", segs)
+
+	b.gso = 0
+	msgs, _ = b.messages(bufs, nil)
+	assert(len(msgs) == len(bufs), t, "gso disabled")
+}
+
+func Test_gro_size(t *testing.T) {
+	oob := gsoControl(1200)
+	assert(groSize(oob) == 0, t, "not gro")
+	// the same layout with type UDP_GRO and int value
+	oob = make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = unix.IPPROTO_UDP, unix.UDP_GRO
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = 1200
+	assert(groSize(oob) == 1200, t, "gro size %d", groSize(oob))
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package suft
+
+import (
+	"errors"
+	"net"
+)
+
+type batchIO struct{}
+
+func newBatchIO(pc net.PacketConn, rsize int) *batchIO {
+	return nil
+}
+
+func (b *batchIO) canBatch(addr net.Addr) bool {
+	return false
+}
+
+func (b *batchIO) readBatch(handle func([]byte, net.Addr)) error {
+	return errors.New("not supported")
+}
+
+func (b *batchIO) writeBatch(bufs [][]byte, addr net.Addr) int {
+	return 0
+}
@@ -3,18 +3,18 @@ package suft
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	_MAX_RETRIES = 6
-	_MIN_RTT     = 8
-	_MIN_RTO     = 30
-	_MIN_ATO     = 2
-	_MAX_ATO     = 10
+	_MIN_RTT     = 100 // us
+	_MIN_RTO     = 30 * _MS
+	_MIN_ATO     = 2 * _MS
+	_MAX_ATO     = 10 * _MS
 	_MIN_SWND    = 10
 	_MAX_SWND    = 960
 )
@@ -54,6 +54,7 @@ func (c *Conn) internalRecvLoop() {
 				return
 			}
 		}
+		atomic.StoreInt64(&c.lastRecv, Now())
 		pk := new(packet)
 		// keep the original buffer, so we could recycle it in future
 		pk.buffer = buf
@@ -66,10 +67,15 @@ func (c *Conn) internalRecvLoop() {
 			c.processAck(pk)
 		}
 		if pk.flag&_F_DATA != 0 {
+			if pk.flag&_F_FRAG != 0 {
+				if pk = c.reassemble(pk); pk == nil {
+					continue
+				}
+			}
 			c.insertData(pk)
 		} else if pk.flag&_F_FIN != 0 {
 			if pk.flag&_F_RESET != 0 {
-				go c.forceShutdownWithLock()
+				go c.teardown(nil, false)
 			} else {
 				go c.closeR(pk)
 			}
@@ -121,10 +127,44 @@ func (c *Conn) internalSendLoop() {
 
 func (c *Conn) internalAckLoop() {
 	var ackTimer = newTimer(c.ato)
+	var aliveTimer = newTimer(0)
+	var pmtuTimer = newTimer(0)
+	var dgramTimer = newTimer(0)
 	var lastAckState byte
+	if next := c.checkPmtu(); next > 0 {
+		pmtuTimer.Reset(next)
+	}
 	for {
 		var v byte
 		select {
+		case <-c.evPmtu:
+			pmtuTimer.Reset(0)
+			continue
+		case <-pmtuTimer.C:
+			if next := c.checkPmtu(); next > 0 {
+				pmtuTimer.Reset(next)
+			}
+			continue
+		case <-c.evDgram:
+			dgramTimer.Reset(0)
+			continue
+		case <-dgramTimer.C:
+			if next := c.checkDatagram(); next > 0 {
+				dgramTimer.Reset(next)
+			}
+			continue
+		case <-c.evKeep:
+			if next := c.checkAlive(); next > 0 {
+				aliveTimer.Reset(next)
+			} else {
+				aliveTimer.Stop()
+			}
+			continue
+		case <-aliveTimer.C:
+			if next := c.checkAlive(); next > 0 {
+				aliveTimer.Reset(next)
+			}
+			continue
 		case <-ackTimer.C:
 			// may cause sending duplicated ack if ato>rtt
 			v = _VACK_QUICK
@@ -150,11 +190,12 @@ func (c *Conn) internalAckLoop() {
 func (c *Conn) retransmit() (rest int64, count int32) {
 	var now, rto = Now(), c.rto
 	var limit = c.cwnd
+	var resend []*qNode
 	for item := c.outQ.head; item != nil && limit > 0; item = item.next {
 		if item.scnt != _SENT_OK { // ACKed has scnt==-1
 			diff := now - item.sent
 			if diff > rto { // already rto
-				c.internalWrite(item)
+				resend = append(resend, item)
 				count++
 			} else {
 				// continue search next min rto duration
@@ -167,6 +208,7 @@ func (c *Conn) retransmit() (rest int64, count int32) {
 			}
 		}
 	}
+	c.writeBatch(resend)
 	c.outDupCnt += int(count)
 	if count > 0 {
 		shrcond := (c.fastRetransmit && count > maxI32(c.cwnd>>5, 4)) || (!c.fastRetransmit && count > c.cwnd>>3)
@@ -193,54 +235,80 @@ func (c *Conn) retransmit2() (count int32) {
 	} else {
 		fRtt += maxI64(c.rtt>>1, 2)
 	}
+	var resend []*qNode
 	for item := c.outQ.head; item != nil && count < limit; item = item.next {
 		if item.scnt != _SENT_OK { // ACKed has scnt==-1
 			if item.miss >= 3 && now-item.sent >= fRtt {
 				item.miss = 0
-				c.internalWrite(item)
+				resend = append(resend, item)
 				count++
 			}
 		}
 	}
+	c.writeBatch(resend)
 	c.fRCnt += int(count)
 	c.outDupCnt += int(count)
 	return
 }
 
 func (c *Conn) inputAndSend(pk *packet) error {
-	item := &qNode{packet: pk}
-	if c.mySeq&3 == 1 {
-		c.tSlotT0 = NowNS()
-	}
+	_, err := c.inputAndSendBatch([]*packet{pk})
+	return err
+}
+
+// send the packets as many as the window allows at once,
+// return the count of sent packets.
+func (c *Conn) inputAndSendBatch(pks []*packet) (int, error) {
 	c.outlock.Lock()
-	// inflight packets exceeds cwnd
-	// inflight includes: 1, unacked; 2, missed
-	for c.outPending >= c.cwnd+c.missed {
+	if atomic.LoadInt32(&c.wClosed) != 0 || atomic.LoadInt32(&c.state) == _S_FIN || c.isAborted() {
+		// the loops may have stopped
+		c.outlock.Unlock()
+		return 0, c.closeErr()
+	}
+	// inflight packets exceeds cwnd or the window of peer
+	// inflight includes: 1, unacked; 2, missed; 3, datagrams
+	var deadline <-chan byte
+	for c.outPending+c.dgramInflight() >= c.cwnd+c.missed || c.sendWindow() <= 0 {
+		var probe <-chan byte
+		if c.sendWindow() <= 0 {
+			// probe the closed window, its update may be lost
+			probe = NewTimerChan(maxI64(c.rto, _MIN_RTO))
+		}
 		c.outlock.Unlock()
 		if c.wtmo > 0 {
 			var tmo int64
 			tmo, c.wtmo = c.wtmo, 0
-			select {
-			case v := <-c.evSend:
-				if v == _CLOSE {
-					return io.EOF
-				}
-			case <-NewTimerChan(tmo):
-				return ErrIOTimeout
-			}
-		} else {
-			if v := <-c.evSend; v == _CLOSE {
-				return io.EOF
+			deadline = NewTimerChan(tmo)
+		}
+		select {
+		case v := <-c.evSend:
+			if v == _CLOSE {
+				return 0, c.closeErr()
 			}
+		case <-probe:
+			c.sendProbe()
+		case <-deadline:
+			return 0, ErrIOTimeout
 		}
 		c.outlock.Lock()
 	}
-	c.outPending++
-	c.outPkCnt++
-	c.mySeq++
-	pk.seq = c.mySeq
-	c.outQ.appendTail(item)
-	c.internalWrite(item)
+	n := int(minI32(int32(len(pks)), minI32(c.cwnd+c.missed-c.outPending-c.dgramInflight(), c.sendWindow())))
+	if c.flatTraffic { // paced one by one
+		n = 1
+	}
+	items := make([]*qNode, n)
+	for i, pk := range pks[:n] {
+		if c.mySeq&3 == 1 {
+			c.tSlotT0 = NowNS()
+		}
+		items[i] = &qNode{packet: pk}
+		c.outPending++
+		c.outPkCnt++
+		c.mySeq++
+		pk.seq = c.mySeq
+		c.outQ.appendTail(items[i])
+	}
+	c.writeBatch(items)
 	c.outlock.Unlock()
 	// active resending timer, must blocking
 	c.evSWnd <- _VSWND_ACTIVE
@@ -257,21 +325,31 @@ func (c *Conn) inputAndSend(pk *packet) error {
 			c.lastSErr >>= 1
 		}
 	}
-	return nil
+	return n, nil
 }
 
 func (c *Conn) internalWrite(item *qNode) {
+	if buf := c.prepareWrite(item); buf != nil {
+		c.sock.WriteTo(buf, c.RemoteAddr())
+	}
+}
+
+// count the sending of item and marshall it, return nil if shutdown
+func (c *Conn) prepareWrite(item *qNode) []byte {
 	if item.scnt >= 20 {
 		// no exception of sending fin
 		if item.flag&_F_FIN != 0 {
 			c.fakeShutdown()
-			c.dest = nil
-			return
+			c.setDest(nil)
+			return nil
 		} else {
 			log.Println("Warn: too many retries", item)
 			if c.urgent > 0 { // abort
-				c.forceShutdown()
-				return
+				if c.forceShutdown() {
+					// in outlock of the loops
+					go c.stopLoops()
+				}
+				return nil
 			} else { // continue to retry 10
 				c.urgent++
 				item.scnt = 10
@@ -285,12 +363,12 @@ func (c *Conn) internalWrite(item *qNode) {
 	if debug >= 3 {
 		var pkType = packetTypeNames[item.flag]
 		if item.flag&_F_SACK != 0 {
-			log.Printf("send %s trp=%d on=%d %x", pkType, item.seq, item.ack, buf[_AH_SIZE+4:])
+			log.Printf("send %s trp=%d on=%d %x", pkType, item.seq, item.ack, buf[_AH_SIZE+_SACK_HEAD:])
 		} else {
 			log.Printf("send %s seq=%d ack=%d scnt=%d len=%d", pkType, item.seq, item.ack, item.scnt, len(buf)-_TH_SIZE)
 		}
 	}
-	c.sock.WriteToUDP(buf, c.dest)
+	return buf
 }
 
 func (c *Conn) logAck(ack uint32) {
@@ -305,8 +383,9 @@ func (c *Conn) makeLastAck() (pk *packet) {
 		return nil
 	}
 	pk = &packet{
-		ack:  maxU32(c.lastAck, c.inQ.maxCtnSeq),
-		flag: _F_ACK,
+		ack:     seqMax(c.lastAck, c.inQ.maxCtnSeq),
+		flag:    _F_ACK,
+		payload: c.appendWindow(nil),
 	}
 	c.logAck(pk.ack)
 	return
@@ -331,8 +410,8 @@ func (c *Conn) makeAck(level byte) (pk *packet) {
 		bmap[0], tbl = 1, 1
 		fakeSAck = true
 	}
-	// head 4-byte: TBL:1 | SCNT:1 | DELAY:2
-	buf := make([]byte, len(bmap)*8+4)
+	// head 6-byte: TBL:1 | SCNT:1 | DELAY:4 (us)
+	buf := make([]byte, len(bmap)*8+_SACK_HEAD, len(bmap)*8+_SACK_HEAD+_WND_SIZE)
 	pk = &packet{
 		ack:     predecessor + 1,
 		flag:    _F_SACK,
@@ -352,35 +431,36 @@ func (c *Conn) makeAck(level byte) (pk *packet) {
 			if delayed <= 0 {
 				delayed = 1
 			}
-			binary.BigEndian.PutUint16(buf[2:], uint16(delayed))
+			binary.BigEndian.PutUint32(buf[2:], uint32(delayed))
 		}
 	}
-	buf1 := buf[4:]
+	buf1 := buf[_SACK_HEAD:]
 	for i, b := range bmap {
 		binary.BigEndian.PutUint64(buf1[i*8:], b)
 	}
+	pk.payload = c.appendWindow(buf)
 	c.logAck(predecessor)
 	return
 }
 
-func unmarshallSAck(data []byte) (bmap []uint64, tbl uint32, delayed uint16, scnt uint8) {
-	if len(data) > 0 {
-		bmap = make([]uint64, len(data)>>3)
+func unmarshallSAck(data []byte) (bmap []uint64, tbl uint32, delayed uint32, scnt uint8) {
+	if len(data) > _SACK_HEAD {
+		bmap = make([]uint64, (len(data)-_SACK_HEAD)>>3)
 	} else {
 		return
 	}
 	tbl = uint32(data[0])
 	scnt = data[1]
-	delayed = binary.BigEndian.Uint16(data[2:])
-	data = data[4:]
+	delayed = binary.BigEndian.Uint32(data[2:])
+	data = data[_SACK_HEAD:]
 	for i := 0; i < len(bmap); i++ {
 		bmap[i] = binary.BigEndian.Uint64(data[i*8:])
 	}
 	return
 }
 
-func calSwnd(bandwidth, rtt int64) int32 {
-	w := int32(bandwidth * rtt / (8000 * _MSS))
+func calSwnd(bandwidth, rtt int64, mss int32) int32 {
+	w := int32(bandwidth * rtt / (8e6 * int64(mss)))
 	if w <= _MAX_SWND {
 		if w >= _MIN_SWND {
 			return w
@@ -424,9 +504,9 @@ func (c *Conn) measure(seq uint32, delayed int64, scnt uint8) {
 			c.rtt = _MIN_RTT
 		}
 		// s-swnd: update 1/4
-		swnd := c.swnd<<3 - c.swnd + calSwnd(c.bandwidth, c.rtt)
-		c.swnd = swnd >> 3
-		c.tSlot = c.rtt * 1e6 / int64(c.swnd)
+		swnd := c.swnd<<3 - c.swnd + calSwnd(c.bandwidth, c.rtt, atomic.LoadInt32(&c.mss))
+		c.swnd = minI32(swnd>>3, c.peerWnd)
+		c.tSlot = c.rtt * 1e3 / int64(c.swnd)
 		c.ato = c.rtt >> 4
 		if c.ato < _MIN_ATO {
 			c.ato = _MIN_ATO
@@ -461,6 +541,7 @@ func (c *Conn) measure(seq uint32, delayed int64, scnt uint8) {
 
 func (c *Conn) processSAck(pk *packet) {
 	c.outlock.Lock()
+	c.updateSendEdge(pk)
 	bmap, tbl, delayed, scnt := unmarshallSAck(pk.payload)
 	if bmap == nil { // bad packet
 		c.outlock.Unlock()
@@ -495,14 +576,17 @@ func (c *Conn) processSAck(pk *packet) {
 
 func (c *Conn) processAck(pk *packet) {
 	c.outlock.Lock()
+	c.updateSendEdge(pk)
 	if end := c.outQ.get(pk.ack); end != nil { // ack hit
+		fin := end.flag&_F_FIN != 0
 		_, deleted := c.outQ.deleteBefore(end)
 		c.ackHit(deleted, 0) // lock is released
 		if debug >= 2 {
 			log.Printf("ACK hit on=%d", pk.ack)
 		}
-		// special case: ack the FIN
-		if pk.seq == _FIN_ACK_SEQ {
+		// special case: the FIN was acked, which is known by the acked
+		// node instead of any value in the packet.
+		if fin {
 			select {
 			case c.evClose <- _S_FIN0:
 			default:
@@ -557,7 +641,9 @@ func (c *Conn) insertData(pk *packet) {
 	exists := c.inQ.contains(pk.seq)
 	// duplicated with already queued or history
 	// means: last ACK were lost
-	if exists || pk.seq <= c.inQ.maxCtnSeq {
+	// or beyond the window, the sender missed the update
+	if exists || !seqAfter(pk.seq, c.inQ.maxCtnSeq) ||
+		(c.rwndEnabled() && seqAfter(pk.seq, c.rcvEdge)) {
 		// then send ACK for dups
 		select {
 		case c.evAck <- _VACK_MUST:
@@ -610,6 +696,10 @@ func (c *Conn) insertData(pk *packet) {
 	case c.evAck <- ackState:
 	default:
 	}
+	if available && atomic.LoadInt32(&c.rClosed) != 0 {
+		c.moveInQReady()
+		available = false
+	}
 	if available { // try notify reader
 		select {
 		case c.evRead <- 1:
@@ -621,14 +711,26 @@ func (c *Conn) insertData(pk *packet) {
 func (c *Conn) readInQ() bool {
 	c.inlock.Lock()
 	defer c.inlock.Unlock()
+	return c.moveInQReady()
+}
+
+// must in inlock, the data will be discarded after CloseRead
+func (c *Conn) moveInQReady() bool {
+	var discard = atomic.LoadInt32(&c.rClosed) != 0
 	// read already <-|-> expected Q
 	//  [lastReadSeq] | [lastReadSeq+1] [lastReadSeq+2] ......
-	if c.inQ.isEqualsHead(c.lastReadSeq+1) && c.lastReadSeq < c.inQ.maxCtnSeq {
+	if c.inQ.isEqualsHead(c.lastReadSeq+1) && seqAfter(c.inQ.maxCtnSeq, c.lastReadSeq) {
 		c.lastReadSeq = c.inQ.maxCtnSeq
 		availabled := c.inQ.get(c.inQ.maxCtnSeq)
 		availabled, _ = c.inQ.deleteBefore(availabled)
 		for i := availabled; i != nil; i = i.next {
-			c.inQReady = append(c.inQReady, i.payload...)
+			if !discard {
+				c.inQReady = append(c.inQReady, i.payload...)
+				c.movedPos += int64(len(i.payload))
+				if i.flag&_F_EOR != 0 && c.features&_FEAT_MSG != 0 {
+					c.msgEnds = append(c.msgEnds, c.movedPos)
+				}
+			}
 			// data was copied, then could recycle memory
 			bpool.Put(i.buffer)
 			i.payload = nil
@@ -642,45 +744,87 @@ func (c *Conn) readInQ() bool {
 // should not call this function concurrently.
 func (c *Conn) Read(buf []byte) (nr int, err error) {
 	for {
+		c.inlock.Lock()
 		if len(c.inQReady) > 0 {
 			n := copy(buf, c.inQReady)
-			c.inQReady = c.inQReady[n:]
+			opened := c.consumeReady(n)
+			c.skipMsgEnds()
+			c.inlock.Unlock()
+			if opened {
+				c.notifyWindow()
+			}
 			return n, nil
 		}
+		c.inlock.Unlock()
 		if !c.readInQ() {
-			if c.rtmo > 0 {
-				var tmo int64
-				tmo, c.rtmo = c.rtmo, 0
-				select {
-				case _, y := <-c.evRead:
-					if !y && len(c.inQReady) == 0 {
-						return 0, io.EOF
-					}
-				case <-NewTimerChan(tmo):
-					return 0, ErrIOTimeout
-				}
-			} else {
-				// only when evRead is closed and inQReady is empty
-				// then could reply eof
-				if _, y := <-c.evRead; !y && len(c.inQReady) == 0 {
-					return 0, io.EOF
-				}
+			// only when evRead is closed and inQReady is empty
+			// then could reply eof
+			if y, err := c.waitRead(); err != nil {
+				return 0, err
+			} else if !y && len(c.inQReady) == 0 {
+				return 0, c.closeErr()
 			}
 		}
 	}
 }
 
+// wait for the coming data, return false if evRead was closed.
+func (c *Conn) waitRead() (bool, error) {
+	if c.rtmo > 0 {
+		var tmo int64
+		tmo, c.rtmo = c.rtmo, 0
+		select {
+		case _, y := <-c.evRead:
+			return y, nil
+		case <-NewTimerChan(tmo):
+			return true, ErrIOTimeout
+		}
+	}
+	_, y := <-c.evRead
+	return y, nil
+}
+
+// discard n bytes of inQReady which were read, must in inlock.
+// return true if the window should be updated.
+func (c *Conn) consumeReady(n int) bool {
+	c.inQReady = c.inQReady[n:]
+	c.readPos += int64(n)
+	return c.windowOpened()
+}
+
 // should not call this function concurrently.
 func (c *Conn) Write(data []byte) (nr int, err error) {
-	for len(data) > 0 && err == nil {
-		//buf := make([]byte, _MSS+_AH_SIZE)
-		buf := bpool.Get(c.mss + _AH_SIZE)
-		body := buf[_TH_SIZE+_CH_SIZE:]
-		n := copy(body, data)
-		nr += n
-		data = data[n:]
-		pk := &packet{flag: _F_DATA, payload: body[:n], buffer: buf[:_AH_SIZE+n]}
-		err = c.inputAndSend(pk)
+	return c.write(data, false)
+}
+
+// send data in packets, the last one is marked as the end of message if eor.
+func (c *Conn) write(data []byte, eor bool) (nr int, err error) {
+	var pks = make([]*packet, 0, _BATCH_SIZE)
+	// an empty message is still a packet
+	var pending = len(data) > 0 || eor
+	for (pending || len(pks) > 0) && err == nil {
+		for pending && len(pks) < _BATCH_SIZE {
+			//buf := make([]byte, _MSS+_AH_SIZE)
+			buf := bpool.Get(int(atomic.LoadInt32(&c.mss)) + _AH_SIZE)
+			body := buf[_TH_SIZE+_CH_SIZE:]
+			n := copy(body, data)
+			data = data[n:]
+			pk := &packet{flag: _F_DATA, payload: body[:n], buffer: buf[:_AH_SIZE+n]}
+			if pending = len(data) > 0; !pending && eor {
+				pk.flag |= _F_EOR
+			}
+			pks = append(pks, pk)
+		}
+		var sent int
+		sent, err = c.inputAndSendBatch(pks)
+		for _, pk := range pks[:sent] {
+			nr += len(pk.payload)
+		}
+		pks = pks[:copy(pks, pks[sent:])]
+	}
+	// the unsent packets never go into outQ
+	for _, pk := range pks {
+		bpool.Put(pk.buffer)
 	}
 	return
 }
@@ -690,7 +834,8 @@ func (c *Conn) LocalAddr() net.Addr {
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.dest
+	d, _ := c.dest.Load().(destAddr)
+	return d.Addr
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
@@ -700,14 +845,14 @@ func (c *Conn) SetDeadline(t time.Time) error {
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	if d := t.UnixNano()/Millisecond - Now(); d > 0 {
+	if d := int64(time.Until(t) / time.Microsecond); d > 0 {
 		c.rtmo = d
 	}
 	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	if d := t.UnixNano()/Millisecond - Now(); d > 0 {
+	if d := int64(time.Until(t) / time.Microsecond); d > 0 {
 		c.wtmo = d
 	}
 	return nil
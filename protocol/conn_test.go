@@ -4,6 +4,7 @@ import (
 	"math/rand"
 	"sort"
 	"testing"
+	"time"
 )
 
 var conn *Conn
@@ -84,3 +85,48 @@ func Test_unordered_insert(t *testing.T) {
 	assert(*last == int(conn.inQ.maxCtnSeq), t, "lastCtnSeq=%d but expected=%d", conn.inQ.maxCtnSeq, *last)
 	t.Logf("lastCtnSeq=%d dirty=%v", conn.inQ.maxCtnSeq, conn.inQDirty)
 }
+
+func Test_sack_delay(t *testing.T) {
+	c := &Conn{
+		outQ: newLinkedMap(_QModeOut),
+		inQ:  newLinkedMap(_QModeIn),
+		rtt:  1e6,
+	}
+	c.insertData(&packet{seq: 1, scnt: 2, payload: []byte{1}})
+	// delayed over 65ms in microseconds
+	c.inQ.lastIns.sent = Now() - 100*_MS
+	pk := c.makeAck(_VACK_MUST)
+	assert(pk != nil && pk.flag&_F_TIME != 0, t, "no time")
+	bmap, _, delayed, scnt := unmarshallSAck(pk.payload)
+	assert(bmap != nil && scnt == 2, t, "bad sack")
+	assert(delayed >= 100*_MS && delayed < 200*_MS, t, "delayed %d", delayed)
+	assert(pk.seq == 1, t, "trp %d", pk.seq)
+}
+
+func Test_monotonic_clock(t *testing.T) {
+	t0, n0 := Now(), NowNS()
+	time.Sleep(2 * time.Millisecond)
+	d, dn := Now()-t0, NowNS()-n0
+	assert(d >= 2*_MS && d < 1e6, t, "now %d", d)
+	assert(dn >= 2e6 && dn/1e3-d < 1e3, t, "ns %d", dn)
+}
+
+func Test_insert_wrap(t *testing.T) {
+	var base uint32 = 0xffffffff - 10
+	c := &Conn{
+		outQ: newLinkedMap(_QModeOut),
+		inQ:  newLinkedMap(_QModeIn),
+	}
+	c.inQ.maxCtnSeq = base
+	c.lastReadSeq = base
+	data := []byte{1}
+	for _, i := range rand.Perm(32) {
+		c.insertData(&packet{seq: base + 1 + uint32(i), payload: data})
+	}
+	assert(c.inQ.maxCtnSeq == base+32, t, "maxCtnSeq=%x", c.inQ.maxCtnSeq)
+	assert(c.readInQ() && len(c.inQReady) == 32, t, "ready %d", len(c.inQReady))
+	assert(c.lastReadSeq == base+32 && c.inQ.size() == 0, t, "lastReadSeq=%x", c.lastReadSeq)
+	// the old one is duplicated
+	c.insertData(&packet{seq: base, payload: data})
+	assert(c.inQ.size() == 0, t, "inserted the old one")
+}
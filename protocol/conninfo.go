@@ -0,0 +1,55 @@
+package suft
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo is a snapshot of a connection on the Endpoint
+type ConnInfo struct {
+	LocalID  uint32
+	RemoteID uint32 // 0 until the handshake finished
+	Remote   net.Addr
+	State    string
+	Age      time.Duration
+	Conn     *Conn
+}
+
+func (c *Conn) info(now int64) ConnInfo {
+	var rid uint32
+	// the rid is set by the handshake before ready
+	if c.isReady() {
+		rid = c.connID.rid
+	}
+	return ConnInfo{
+		LocalID:  c.connID.lid,
+		RemoteID: rid,
+		Remote:   c.RemoteAddr(),
+		State:    stateNames[atomic.LoadInt32(&c.state)],
+		Age:      time.Duration(now-c.created) * time.Microsecond,
+		Conn:     c,
+	}
+}
+
+// Conns returns the snapshot of live connections ordered by LocalID
+func (e *Endpoint) Conns() []ConnInfo {
+	conns := e.snapshot()
+	now := Now()
+	infos := make([]ConnInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.info(now)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LocalID < infos[j].LocalID
+	})
+	return infos
+}
+
+// ConnByID returns the connection by its LocalID, or nil
+func (e *Endpoint) ConnByID(lid uint32) *Conn {
+	e.mlock.RLock()
+	defer e.mlock.RUnlock()
+	return e.lRegistry[lid]
+}
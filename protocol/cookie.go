@@ -0,0 +1,125 @@
+package suft
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+)
+
+// Stateless handshake
+//
+// A SYN without valid cookie is answered by a CTRL cookie packet and then
+// forgotten, the cookie is the HMAC of remote addr, remote connID and
+// current time slot. The dialer resends the SYN with the cookie to prove
+// that it owns the address, only then the connection will be created.
+//
+//	cookie: TYPE:1 | COOKIE:16
+//	SYN:    hello | _O_COOKIE:1 | 16 | COOKIE:16
+const (
+	_COOKIE_SIZE = 16
+	// about 8 seconds per slot, the cookie is valid in current and prev slot.
+	_COOKIE_SLOT_BITS = 23
+)
+
+const (
+	_HANDSHAKE_WORKERS = 16
+	_HANDSHAKE_QUEUE   = 256
+)
+
+type synPacket struct {
+	id    connID
+	addr  net.Addr
+	buf   []byte
+	shard int
+}
+
+func newCookieKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func (e *Endpoint) makeCookie(addr net.Addr, rid uint32, slot int64) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:], rid)
+	binary.BigEndian.PutUint64(b[4:], uint64(slot))
+	m := hmac.New(sha256.New, e.cookieKey)
+	m.Write(b[:])
+	m.Write([]byte(addr.String()))
+	return m.Sum(nil)[:_COOKIE_SIZE]
+}
+
+func (e *Endpoint) checkCookie(addr net.Addr, rid uint32, cookie []byte) bool {
+	slot := Now() >> _COOKIE_SLOT_BITS
+	return hmac.Equal(cookie, e.makeCookie(addr, rid, slot)) ||
+		hmac.Equal(cookie, e.makeCookie(addr, rid, slot-1))
+}
+
+func (e *Endpoint) sendCookie(shard int, addr net.Addr, id connID) {
+	payload := make([]byte, 1, 1+_COOKIE_SIZE)
+	payload[0] = _C_COOKIE
+	payload = append(payload, e.makeCookie(addr, id.rid, Now()>>_COOKIE_SLOT_BITS)...)
+	pk := &packet{flag: _F_CTRL, payload: payload}
+	e.socks[shard].WriteTo(nodeOf(pk).marshall(id), addr)
+}
+
+// the cookie replied by the acceptor
+func parseCookie(pk *packet) []byte {
+	if pk.flag == _F_CTRL && len(pk.payload) >= 1+_COOKIE_SIZE && pk.payload[0] == _C_COOKIE {
+		return pk.payload[1 : 1+_COOKIE_SIZE]
+	}
+	return nil
+}
+
+// handle the SYN without allocating anything until the cookie is verified
+func (e *Endpoint) handleSyn(id connID, addr net.Addr, buf []byte, shard int) {
+	if buf[_TH_SIZE+8] != _F_SYN {
+		dumpb("drop", buf)
+		return
+	}
+	if e.isClosed() { // shutting down
+		e.resetPeer(shard, addr, id)
+		return
+	}
+	if !e.admission.permitted(addr) {
+		e.refuse(shard, addr, id, "denied")
+		return
+	}
+	if !e.admission.allowSyn(addr) {
+		return
+	}
+	var h hello
+	if !h.unmarshall(buf[_AH_SIZE:]) {
+		dumpb("drop syn", buf)
+		return
+	}
+	// the address is verified before replying anything else
+	if h.cookie == nil || !e.checkCookie(addr, id.rid, h.cookie) {
+		e.sendCookie(shard, addr, id)
+		return
+	}
+	if reason := h.reject(); reason != 0 {
+		e.rejectSyn(shard, addr, id, reason)
+		return
+	}
+	if !e.admission.accepted(addr) {
+		e.refuse(shard, addr, id, "filtered")
+		return
+	}
+	select {
+	case e.synQueue <- &synPacket{id, addr, buf, shard}:
+	default:
+		// workers are busy, the dialer will retry.
+		dumpb("drop syn", buf)
+	}
+}
+
+func (e *Endpoint) handshakeWorker() {
+	for s := range e.synQueue {
+		e.acceptNewConn(s.id, s.addr, s.buf, s.shard)
+	}
+}
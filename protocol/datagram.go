@@ -0,0 +1,173 @@
+package suft
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// Unreliable datagrams
+//
+// The datagrams are carried by CTRL packets of the connection, they are
+// neither ordered nor retransmitted, then never block the stream. Every
+// datagram is acked by the peer, and counted in flight by the cwnd shared
+// with the stream until it was acked or taken as lost after rto. They are
+// counted apart from the outPending of stream, so their acks and losses
+// don't feed the congestion control of stream. The
+// datagram couldn't be sent while the cwnd is full, and the received ones
+// are dropped if the reader is too slow.
+//
+//	datagram: TYPE:1 | ID:4 | data
+//	ack:      TYPE:1 | ID:4
+const (
+	_DGRAM_HEAD  = 5
+	_DGRAM_QUEUE = 64 // received but not read
+)
+
+var ErrCongested = errors.New("Congestion window is full")
+
+type dgramState struct {
+	id     uint32
+	sent   map[uint32]int64 // in flight, in outlock
+	recv   chan []byte
+	closed chan struct{} // closed with evRead
+}
+
+func (d *dgramState) init() {
+	d.sent = make(map[uint32]int64)
+	d.recv = make(chan []byte, _DGRAM_QUEUE)
+	d.closed = make(chan struct{})
+}
+
+// SendDatagram sends b unreliably, which should fit in one packet.
+// ErrCongested is returned instead of blocking if the cwnd is full.
+func (c *Conn) SendDatagram(b []byte) error {
+	if c.features&_FEAT_DGRAM == 0 {
+		return ErrIncompatible
+	}
+	if len(b) > int(atomic.LoadInt32(&c.mss))-_DGRAM_HEAD {
+		return ErrMsgTooLarge
+	}
+	c.outlock.Lock()
+	if atomic.LoadInt32(&c.state) != _S_EST1 || atomic.LoadInt32(&c.wClosed) != 0 {
+		c.outlock.Unlock()
+		return c.closeErr()
+	}
+	if c.outPending+c.dgramInflight() >= c.cwnd+c.missed {
+		c.outlock.Unlock()
+		return ErrCongested
+	}
+	d := &c.dgram
+	d.id++
+	if len(d.sent) == 0 {
+		c.notifyDatagram()
+	}
+	d.sent[d.id] = Now()
+	c.outPkCnt++
+	payload := make([]byte, _DGRAM_HEAD+len(b))
+	payload[0] = _C_DATAGRAM
+	binary.BigEndian.PutUint32(payload[1:], d.id)
+	copy(payload[_DGRAM_HEAD:], b)
+	dest := c.RemoteAddr()
+	c.outlock.Unlock()
+	c.writeCtrlTo(payload, dest)
+	return nil
+}
+
+// ReceiveDatagram returns the next datagram sent by the peer.
+func (c *Conn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	// the queued ones first even though closed
+	select {
+	case b := <-c.dgram.recv:
+		return b, nil
+	default:
+	}
+	select {
+	case b := <-c.dgram.recv:
+		return b, nil
+	case <-c.dgram.closed:
+		return nil, c.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// the datagrams in flight, must in outlock
+func (c *Conn) dgramInflight() int32 {
+	return int32(len(c.dgram.sent))
+}
+
+func (c *Conn) notifyDatagram() {
+	select {
+	case c.evDgram <- 1:
+	default:
+	}
+}
+
+// called by internalAckLoop, release the cwnd of the lost datagrams,
+// return the delay of next check, 0 means no check.
+func (c *Conn) checkDatagram() int64 {
+	c.outlock.Lock()
+	var now, tmo = Now(), maxI64(c.rto, _MIN_RTO)
+	var lost int32
+	var next int64
+	for id, sent := range c.dgram.sent {
+		if rest := sent + tmo - now; rest <= 0 {
+			delete(c.dgram.sent, id)
+			lost++
+		} else if next == 0 || rest < next {
+			next = rest
+		}
+	}
+	c.outlock.Unlock()
+	if lost > 0 {
+		select {
+		case c.evSend <- 1:
+		default:
+		}
+	}
+	return next
+}
+
+func isDgramCtrl(buf []byte) bool {
+	return buf[_TH_SIZE+8] == _F_CTRL && len(buf) >= _AH_SIZE+_DGRAM_HEAD &&
+		(buf[_AH_SIZE] == _C_DATAGRAM || buf[_AH_SIZE] == _C_DATAGRAM_ACK)
+}
+
+func (c *Conn) processDatagram(addr net.Addr, buf []byte) {
+	body := buf[_AH_SIZE:]
+	switch body[0] {
+	case _C_DATAGRAM:
+		atomic.StoreInt64(&c.lastRecv, Now())
+		ack := make([]byte, _DGRAM_HEAD)
+		ack[0] = _C_DATAGRAM_ACK
+		copy(ack[1:], body[1:_DGRAM_HEAD])
+		c.writeCtrlTo(ack, addr)
+		if atomic.LoadInt32(&c.rClosed) != 0 {
+			return
+		}
+		// the buf will be reused
+		data := make([]byte, len(body)-_DGRAM_HEAD)
+		copy(data, body[_DGRAM_HEAD:])
+		select {
+		case c.dgram.recv <- data:
+		default: // the reader is too slow
+		}
+
+	case _C_DATAGRAM_ACK:
+		id := binary.BigEndian.Uint32(body[1:])
+		c.outlock.Lock()
+		_, y := c.dgram.sent[id]
+		delete(c.dgram.sent, id)
+		c.outlock.Unlock()
+		// or late, it was taken as lost
+		if y {
+			select {
+			case c.evSend <- 1:
+			default:
+			}
+		}
+	}
+}
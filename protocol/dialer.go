@@ -0,0 +1,60 @@
+package suft
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errNoEndpoint = errors.New("Dialer without endpoint")
+
+// A Dialer contains options for connecting to an address through an Endpoint.
+// It is similar to net.Dialer.
+type Dialer struct {
+	// Endpoint is used for sending handshakes and carrying the connections.
+	Endpoint *Endpoint
+
+	// Timeout is the maximum amount of time a dial will wait for
+	// the handshake to complete. Zero means no timeout.
+	Timeout time.Duration
+
+	// Deadline is the absolute point in time after which the dial
+	// will fail. Zero means no deadline.
+	Deadline time.Time
+}
+
+func (d *Dialer) deadline(ctx context.Context, now time.Time) (earliest time.Time) {
+	if d.Timeout > 0 {
+		earliest = now.Add(d.Timeout)
+	}
+	if dl, ok := ctx.Deadline(); ok && (earliest.IsZero() || dl.Before(earliest)) {
+		earliest = dl
+	}
+	if !d.Deadline.IsZero() && (earliest.IsZero() || d.Deadline.Before(earliest)) {
+		earliest = d.Deadline
+	}
+	return
+}
+
+// Dial connects to the addr using context.Background().
+func (d *Dialer) Dial(addr string) (*Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to the addr using the provided context.
+// If the context is canceled or expires before the handshake is complete,
+// the handshake will be aborted and ctx.Err() returned.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (*Conn, error) {
+	if ctx == nil {
+		panic("nil context")
+	}
+	if d.Endpoint == nil {
+		return nil, errNoEndpoint
+	}
+	if deadline := d.deadline(ctx, time.Now()); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return d.Endpoint.DialContext(ctx, addr)
+}
@@ -1,6 +1,7 @@
 package suft
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -17,6 +18,7 @@ import (
 
 const (
 	_SO_BUF_SIZE = 8 << 20
+	_BACKLOG     = 128
 )
 
 var (
@@ -24,15 +26,43 @@ var (
 )
 
 type Params struct {
-	LocalAddr      string
+	LocalAddr      string // ":port" serves IPv4 and IPv6 both
 	Bandwidth      int64
-	Mtu            int
+	Mtu            int // of the link, eg. 9000 for jumbo frames, default 1500
 	IsServ         bool
+	Symmetric      bool // dial out and accept incoming on the same endpoint
 	FastRetransmit bool
 	FlatTraffic    bool
 	EnablePprof    bool
 	Stacktrace     bool
 	Debug          int
+
+	// number of goroutines admitting the verified SYNs, default 16
+	HandshakeWorkers int
+	// max established connections waiting for Accept, default 128
+	// the overflows will be refused.
+	Backlog int
+
+	// admission control of incoming connections
+	Allow         []string // CIDR, accept only from these if not empty
+	Deny          []string // CIDR
+	MaxConns      int      // max incoming connections, 0 means unlimited
+	MaxConnsPerIP int      // max incoming connections from one IP
+	SynRate       int      // max SYN per second from one IP
+	// return false to refuse the peer, called after the address was proven
+	AcceptFilter func(*net.UDPAddr) bool
+
+	// open N sockets on LocalAddr with SO_REUSEPORT (linux), each one
+	// has its own reader. 0 or 1 means a single socket.
+	Shards int
+
+	// "udp" by default, "udp4", "udp6" or "unixgram" which addresses the
+	// peers by socket path, a temporary path is bound if LocalAddr is empty.
+	Network string
+
+	// max bytes buffered for the reader per connection, default 4MB,
+	// then the sender is paused by the advertised window.
+	RecvBuffer int
 }
 
 type connID struct {
@@ -41,15 +71,27 @@ type connID struct {
 }
 
 type Endpoint struct {
-	udpconn    *net.UDPConn
+	sock       net.PacketConn
+	socks      []net.PacketConn // shards, socks[0] is sock
+	bio        []*batchIO       // batched I/O of socks, nil if unsupported
+	sockPath   string           // unixgram socket file bound by NewEndpoint
+	rsize      int              // receiving buffer size
+	readers    sync.WaitGroup
 	state      int32
 	idSeq      uint32
 	isServ     bool
 	listenChan chan *Conn
+	backlog    chan byte
+	admission  *admission
+	closing    chan byte
+	closeOnce  sync.Once
 	lRegistry  map[uint32]*Conn
 	rRegistry  map[string][]uint32
+	dialing    map[string]*Conn
+	synQueue   chan *synPacket
+	cookieKey  []byte
+	fallback   atomic.Value // func([]byte, *net.UDPAddr)
 	mlock      sync.RWMutex
-	timeout    *iTimer
 	params     Params
 }
 
@@ -58,81 +100,158 @@ func (c *connID) setRid(b []byte) {
 }
 
 func init() {
-	bpool.Init(0, 2000)
-	rand.Seed(NowNS())
+	bpool.Init(0, 16<<10)
+	rand.Seed(time.Now().UnixNano())
 }
 
 func NewEndpoint(p *Params) (*Endpoint, error) {
+	var socks []net.PacketConn
+	var err error
+	var network, sockPath = p.Network, ""
+	if network == "" {
+		network = "udp"
+	}
+	switch {
+	case network == "unixgram":
+		if p.Shards > 1 {
+			return nil, fmt.Errorf("sharding over %s", network)
+		}
+		if sockPath = p.LocalAddr; sockPath == "" {
+			sockPath = tempSockPath()
+		}
+		var conn net.PacketConn
+		conn, err = net.ListenPacket(network, sockPath)
+		socks = []net.PacketConn{conn}
+	case p.Shards > 1:
+		socks, err = listenReusePort(network, p.LocalAddr, p.Shards)
+	default:
+		var conn net.PacketConn
+		conn, err = net.ListenPacket(network, p.LocalAddr)
+		socks = []net.PacketConn{conn}
+	}
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEndpoint(socks, p)
+	if err != nil {
+		for _, s := range socks {
+			s.Close()
+		}
+		removeSockPath(sockPath)
+		return nil, err
+	}
+	e.sockPath = sockPath
+	return e, nil
+}
+
+// NewEndpointFromPacketConn builds an Endpoint on top of the given pc,
+// the pc is owned by the Endpoint from now on and closed with it.
+func NewEndpointFromPacketConn(pc net.PacketConn, p *Params) (*Endpoint, error) {
+	return newEndpoint([]net.PacketConn{pc}, p)
+}
+
+// Sharding
+//
+// Each shard socket has its own reader, the kernel spreads the peers over
+// them by hashing the address. The local ids are partitioned by shard:
+// lid % len(socks) is the index of the socket which the conn writes to,
+// and it was accepted from. The packets of a conn may arrive on any shard,
+// e.g. the replies to a dialed conn are hashed regardless of its lid, so
+// the registry and Accept queue are shared. The replies without conn, such
+// as RESET and cookie, go back through the shard which received the packet.
+func newEndpoint(socks []net.PacketConn, p *Params) (*Endpoint, error) {
 	set_debug_params(p)
 	if p.Bandwidth <= 0 || p.Bandwidth > 100 {
 		return nil, fmt.Errorf("bw->(0,100]")
 	}
-	conn, err := net.ListenPacket("udp", p.LocalAddr)
+	if p.Mtu != 0 && (p.Mtu < _MIN_MTU || p.Mtu > _MAX_MTU) {
+		return nil, fmt.Errorf("mtu->[%d,%d]", _MIN_MTU, _MAX_MTU)
+	}
+	backlog := p.Backlog
+	if backlog <= 0 {
+		backlog = _BACKLOG
+	}
+	adm, err := newAdmission(p)
 	if err != nil {
 		return nil, err
 	}
 	e := &Endpoint{
-		udpconn:    conn.(*net.UDPConn),
+		sock:       socks[0],
+		socks:      socks,
 		idSeq:      1,
-		isServ:     p.IsServ,
-		listenChan: make(chan *Conn, 1),
+		isServ:     p.IsServ || p.Symmetric,
+		listenChan: make(chan *Conn, backlog),
+		backlog:    make(chan byte, backlog),
+		admission:  adm,
+		closing:    make(chan byte),
 		lRegistry:  make(map[uint32]*Conn),
 		rRegistry:  make(map[string][]uint32),
-		timeout:    newTimer(0),
+		dialing:    make(map[string]*Conn),
+		synQueue:   make(chan *synPacket, _HANDSHAKE_QUEUE),
+		cookieKey:  newCookieKey(),
+		rsize:      maxI(_MAX_PACKET, p.Mtu-_UDP4_HDR),
 		params:     *p,
 	}
 	if e.isServ {
 		e.state = _S_EST0
 	} else { // client
 		e.state = _S_EST1
+	}
+	if !p.IsServ { // client or symmetric
 		e.idSeq = uint32(rand.Int31())
 	}
 	e.params.Bandwidth = p.Bandwidth << 20 // mbps to bps
-	e.udpconn.SetReadBuffer(_SO_BUF_SIZE)
-	go e.internal_listen()
+	if e.isServ {
+		workers := p.HandshakeWorkers
+		if workers <= 0 {
+			workers = _HANDSHAKE_WORKERS
+		}
+		for i := 0; i < workers; i++ {
+			go e.handshakeWorker()
+		}
+	}
+	e.bio = make([]*batchIO, len(socks))
+	for i, pc := range socks {
+		e.bio[i] = newBatchIO(pc, e.rsize)
+		setDontFragment(pc)
+		if rb, y := pc.(interface {
+			SetReadBuffer(int) error
+		}); y {
+			rb.SetReadBuffer(_SO_BUF_SIZE)
+		}
+		e.readers.Add(1)
+		go e.internal_listen(i)
+	}
+	// stop handshake workers
+	go func() {
+		e.readers.Wait()
+		close(e.synQueue)
+	}()
 	return e, nil
 }
 
-func (e *Endpoint) internal_listen() {
-	const rtmo = 30 * 1e9
-	var id connID
-	var pdCtx = getPollCtx(e.udpconn)
+func (e *Endpoint) internal_listen(shard int) {
+	const rtmo = 30 * time.Second
+	var sock = e.socks[shard]
+	var timeout = newTimer(0)
+	var handle = func(buf []byte, addr net.Addr) {
+		if isPacket(buf) {
+			e.handlePacket(shard, buf, addr, timeout)
+		} else if isLegacySyn(buf) {
+			e.rejectLegacySyn(shard, buf, addr)
+		} else {
+			e.handleForeign(buf, addr)
+		}
+	}
+	defer e.readers.Done()
 	for {
-		//var buf = make([]byte, 1600)
-		var buf = bpool.Get(1600)
-		net_pollSetDeadline(pdCtx, rtmo+runtimeNano(), 'r')
-		n, addr, err := e.udpconn.ReadFromUDP(buf)
-		if err == nil && n >= _AH_SIZE {
-			buf = buf[:n]
-			e.getConnID(&id, buf)
-
-			switch id.lid {
-			case 0: // new connection
-				if e.isServ {
-					go e.acceptNewConn(id, addr, buf)
-				} else {
-					dumpb("drop", buf)
-				}
-
-			case _INVALID_SEQ:
-				dumpb("drop invalid", buf)
-
-			default: // old connection
-				e.mlock.RLock()
-				conn := e.lRegistry[id.lid]
-				e.mlock.RUnlock()
-				if conn != nil {
-					e.dispatch(conn, buf)
-				} else {
-					e.resetPeer(addr, id)
-					dumpb("drop null", buf)
-				}
-			}
-
-		} else if err != nil {
+		sock.SetReadDeadline(time.Now().Add(rtmo))
+		if err := e.readPackets(shard, handle); err != nil {
 			// idle process
 			if nerr, y := err.(net.Error); y && nerr.Timeout() {
-				e.idleProcess()
+				if shard == 0 {
+					e.idleProcess()
+				}
 				continue
 			}
 			// other errors
@@ -145,6 +264,60 @@ func (e *Endpoint) internal_listen() {
 	}
 }
 
+func (e *Endpoint) handlePacket(shard int, buf []byte, addr net.Addr, timeout *iTimer) {
+	var id connID
+	e.getConnID(&id, buf)
+
+	switch id.lid {
+	case 0: // new connection
+		if conn := e.simultaneousOpen(id, addr); conn != nil {
+			e.dispatch(conn, buf, timeout)
+		} else if e.isServ {
+			e.handleSyn(id, addr, buf, shard)
+		} else {
+			dumpb("drop", buf)
+		}
+
+	case _INVALID_SEQ:
+		dumpb("drop invalid", buf)
+
+	default: // old connection
+		e.mlock.RLock()
+		conn := e.lRegistry[id.lid]
+		e.mlock.RUnlock()
+		if conn != nil {
+			if !conn.isReady() {
+				// the controls are dropped until the handshake finished
+				if isPathCtrl(buf) || isPmtuCtrl(buf) || isDgramCtrl(buf) {
+					dumpb("drop ctrl", buf)
+				} else {
+					e.dispatch(conn, buf, timeout)
+				}
+				return
+			}
+			if isPathCtrl(buf) {
+				conn.processPath(addr, buf)
+				return
+			}
+			if isPmtuCtrl(buf) {
+				conn.processPmtu(addr, buf)
+				return
+			}
+			if dest := conn.RemoteAddr(); dest != nil && !sameAddr(addr, dest) {
+				conn.validatePath(addr)
+			}
+			if isDgramCtrl(buf) {
+				conn.processDatagram(addr, buf)
+				return
+			}
+			e.dispatch(conn, buf, timeout)
+		} else {
+			e.resetPeer(shard, addr, id)
+			dumpb("drop null", buf)
+		}
+	}
+}
+
 func (e *Endpoint) idleProcess() {
 	// recycle/shrink memory
 	bpool.Drain()
@@ -161,24 +334,106 @@ func (e *Endpoint) idleProcess() {
 }
 
 func (e *Endpoint) Dial(addr string) (*Conn, error) {
-	rAddr, err := net.ResolveUDPAddr("udp", addr)
+	return e.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to the addr, the handshake will be aborted
+// and ctx.Err() returned once the ctx is done. The addresses of hostname
+// are tried by happy eyeballs, see dialParallel.
+func (e *Endpoint) DialContext(ctx context.Context, addr string) (*Conn, error) {
+	if e.isClosed() {
+		return nil, net.ErrClosed
+	}
+	cands, err := e.resolveCandidates(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
+	if len(cands) == 1 {
+		return e.dialAddr(ctx, cands[0])
+	}
+	return e.dialParallel(ctx, cands)
+}
+
+func (e *Endpoint) dialAddr(ctx context.Context, rAddr net.Addr) (*Conn, error) {
+	if e.isClosed() {
+		return nil, net.ErrClosed
+	}
+	rKey := rAddr.String()
 	e.mlock.Lock()
-	e.idSeq++
-	id := connID{e.idSeq, 0}
+	id := connID{e.nextID(int(e.idSeq % uint32(len(e.socks)))), 0}
 	conn := NewConn(e, rAddr, id)
 	e.lRegistry[id.lid] = conn
+	// the first pending dialing could meet the simultaneous open
+	if e.dialing[rKey] == nil {
+		e.dialing[rKey] = conn
+		defer e.finishDialing(rKey, conn)
+	}
 	e.mlock.Unlock()
-	if atomic.LoadInt32(&e.state) != _S_FIN {
-		err = conn.initConnection(nil)
-		return conn, err
+	if err := conn.initConnection(ctx, nil); err != nil {
+		if conn.connID.rid != 0 && err != ErrConnRefused {
+			// the peer may have accepted it
+			e.resetPeer(e.shardOf(id.lid), rAddr, conn.connID)
+		}
+		e.removeConn(conn.connID, rAddr)
+		return nil, err
+	}
+	// filter syn packets from the peer of this connection, see acceptNewConn
+	e.mlock.Lock()
+	if newArr := insertRid(e.rRegistry[rKey], conn.connID.rid); newArr != nil {
+		e.rRegistry[rKey] = newArr
+	}
+	e.mlock.Unlock()
+	return conn, nil
+}
+
+func (e *Endpoint) finishDialing(rKey string, conn *Conn) {
+	e.mlock.Lock()
+	if e.dialing[rKey] == conn {
+		delete(e.dialing, rKey)
+	}
+	e.mlock.Unlock()
+}
+
+// two peers dial each other at the same time, then the syn from the peer
+// will be given to the pending dialing instead of creating a new connection.
+func (e *Endpoint) simultaneousOpen(id connID, addr net.Addr) *Conn {
+	rKey := addr.String()
+	e.mlock.RLock()
+	conn := e.dialing[rKey]
+	e.mlock.RUnlock()
+	if conn == nil {
+		return nil
+	}
+	e.mlock.Lock()
+	defer e.mlock.Unlock()
+	if newArr := insertRid(e.rRegistry[rKey], id.rid); newArr != nil {
+		e.rRegistry[rKey] = newArr
+	}
+	return conn
+}
+
+// Params.Network, or the one of socket given by NewEndpointFromPacketConn.
+// The socket always reports "udp" even if it was bound by "udp4" or "udp6".
+func (e *Endpoint) network() string {
+	if e.params.Network != "" {
+		return e.params.Network
+	}
+	return e.sock.LocalAddr().Network()
+}
+
+// resolve the addr within the network of endpoint
+func (e *Endpoint) resolveAddr(addr string) (net.Addr, error) {
+	switch network := e.network(); network {
+	case "udp", "udp4", "udp6":
+		return net.ResolveUDPAddr(network, addr)
+	case "unixgram":
+		return net.ResolveUnixAddr(network, addr)
+	default:
+		return nil, net.UnknownNetworkError(network)
 	}
-	return nil, io.EOF
 }
 
-func (e *Endpoint) acceptNewConn(id connID, addr *net.UDPAddr, buf []byte) {
+func (e *Endpoint) acceptNewConn(id connID, addr net.Addr, buf []byte, shard int) {
 	rKey := addr.String()
 	e.mlock.Lock()
 	// map: remoteAddr => remoteConnID
@@ -190,74 +445,232 @@ func (e *Endpoint) acceptNewConn(id connID, addr *net.UDPAddr, buf []byte) {
 		log.Println("Warn: duplicated connection", addr)
 		return
 	}
-	e.idSeq++
-	id.lid = e.idSeq
+	admitKey, ok := e.admission.reserve(addr)
+	if !ok {
+		e.unregisterRid(rKey, id.rid)
+		e.mlock.Unlock()
+		e.refuse(shard, addr, id, "too many connections")
+		return
+	}
+	// reserve a place in the accept queue, or refuse it
+	select {
+	case e.backlog <- 1:
+	default:
+		e.admission.release(admitKey)
+		e.unregisterRid(rKey, id.rid)
+		e.mlock.Unlock()
+		e.resetPeer(shard, addr, id)
+		log.Println("Warn: backlog overflow, refused", addr)
+		return
+	}
+	id.lid = e.nextID(shard)
 	conn := NewConn(e, addr, id)
+	conn.inbound, conn.admitKey = true, admitKey
 	e.lRegistry[id.lid] = conn
 	e.mlock.Unlock()
-	err := conn.initConnection(buf)
+	// waiting ack3 doesn't hold the worker, the handshakes in progress are
+	// bounded by the places of backlog
+	go e.finishAccept(conn, addr, buf)
+}
+
+func (e *Endpoint) finishAccept(conn *Conn, addr net.Addr, buf []byte) {
+	err := conn.initConnection(context.Background(), buf)
 	if err == nil {
-		select {
-		case e.listenChan <- conn:
-		case <-time.After(_10ms):
-			log.Println("Warn: no listener")
-		}
+		// never blocking, the place was reserved
+		e.listenChan <- conn
 	} else {
-		e.removeConn(id, addr)
+		<-e.backlog
+		e.removeConn(conn.connID, addr)
 		log.Println("Error: init_connection", addr, err)
 	}
 }
 
-func (e *Endpoint) removeConn(id connID, addr *net.UDPAddr) {
+func (e *Endpoint) removeConn(id connID, addr net.Addr) {
 	e.mlock.Lock()
-	delete(e.lRegistry, id.lid)
-	rKey := addr.String()
-	if newArr := deleteRid(e.rRegistry[rKey], id.rid); newArr != nil {
+	if c := e.lRegistry[id.lid]; c != nil {
+		delete(e.lRegistry, id.lid)
+		if c.inbound {
+			e.admission.release(c.admitKey)
+		}
+	}
+	if addr != nil {
+		e.unregisterRid(addr.String(), id.rid)
+	}
+	e.mlock.Unlock()
+}
+
+// allocate a local id in the partition of the shard, must in mlock
+func (e *Endpoint) nextID(shard int) uint32 {
+	n := uint32(len(e.socks))
+	for {
+		e.idSeq++
+		lid := e.idSeq*n + uint32(shard)
+		if lid != 0 && lid != _INVALID_SEQ && e.lRegistry[lid] == nil {
+			return lid
+		}
+	}
+}
+
+func (e *Endpoint) shardOf(lid uint32) int {
+	return int(lid % uint32(len(e.socks)))
+}
+
+// must in mlock
+func (e *Endpoint) unregisterRid(rKey string, rid uint32) {
+	if newArr := deleteRid(e.rRegistry[rKey], rid); newArr != nil {
 		if len(newArr) > 0 {
 			e.rRegistry[rKey] = newArr
 		} else {
 			delete(e.rRegistry, rKey)
 		}
 	}
+}
+
+// move the rid of migrated connection to the new remote addr
+func (e *Endpoint) moveConn(id connID, from, to net.Addr) {
+	fKey, tKey := from.String(), to.String()
+	e.mlock.Lock()
+	if newArr := deleteRid(e.rRegistry[fKey], id.rid); newArr != nil {
+		if len(newArr) > 0 {
+			e.rRegistry[fKey] = newArr
+		} else {
+			delete(e.rRegistry, fKey)
+		}
+		if newArr = insertRid(e.rRegistry[tKey], id.rid); newArr != nil {
+			e.rRegistry[tKey] = newArr
+		}
+	}
 	e.mlock.Unlock()
 }
 
+// the state of endpoint draining the connections by Shutdown, besides
+// _S_EST0 of server, _S_EST1 of client and _S_FIN of closed.
+const _E_SHUTDOWN = _S_EST1 + 1
+
+func (e *Endpoint) isClosed() bool {
+	state := atomic.LoadInt32(&e.state)
+	return state == _S_FIN || state == _E_SHUTDOWN
+}
+
 // net.Listener
+// Close resets all connections immediately and closes the socket.
 func (e *Endpoint) Close() error {
+	for {
+		state := atomic.LoadInt32(&e.state)
+		if state == _S_FIN {
+			return nil
+		}
+		if atomic.CompareAndSwapInt32(&e.state, state, _S_FIN) {
+			break
+		}
+	}
+	// release listeners
+	e.closeOnce.Do(func() { close(e.closing) })
+	for _, c := range e.snapshot() {
+		c.hardReset(net.ErrClosed)
+	}
+	var err error
+	for _, s := range e.socks {
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	}
+	removeSockPath(e.sockPath)
+	return err
+}
+
+// Shutdown gracefully closes the endpoint: stop accepting, send fin
+// on every connection and wait for them to finish until the ctx is done,
+// then reset the remaining connections. It returns ctx.Err() if the ctx
+// expires before all connections are closed.
+func (e *Endpoint) Shutdown(ctx context.Context) (err error) {
 	state := atomic.LoadInt32(&e.state)
-	if state > 0 && atomic.CompareAndSwapInt32(&e.state, state, _S_FIN) {
-		err := e.udpconn.Close()
-		e.lRegistry = nil
-		e.rRegistry = nil
-		select { // release listeners
-		case e.listenChan <- nil:
-		default:
+	if state == _S_FIN || state == _E_SHUTDOWN ||
+		!atomic.CompareAndSwapInt32(&e.state, state, _E_SHUTDOWN) {
+		return net.ErrClosed
+	}
+	e.closeOnce.Do(func() { close(e.closing) })
+	var closing = make(map[*Conn]bool)
+	var ticker = time.NewTicker(_10ms)
+	defer ticker.Stop()
+Draining:
+	for {
+		conns := e.snapshot()
+		if len(conns) == 0 {
+			break
+		}
+		for _, c := range conns {
+			// skip the handshaking until it was established, and let the
+			// closing or half-closed ones finish by themselves, Close of
+			// them would reset the peer.
+			if !closing[c] && atomic.LoadInt32(&c.state) == _S_EST1 {
+				closing[c] = true
+				go c.Close()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break Draining
+		case <-ticker.C:
 		}
-		return err
 	}
-	return nil
+	if err0 := e.Close(); err == nil {
+		err = err0
+	}
+	return
+}
+
+// snapshot of registered connections
+func (e *Endpoint) snapshot() []*Conn {
+	e.mlock.RLock()
+	defer e.mlock.RUnlock()
+	conns := make([]*Conn, 0, len(e.lRegistry))
+	for _, c := range e.lRegistry {
+		conns = append(conns, c)
+	}
+	return conns
 }
 
 // net.Listener
 func (e *Endpoint) Addr() net.Addr {
-	return e.udpconn.LocalAddr()
+	return e.sock.LocalAddr()
 }
 
 // net.Listener
 func (e *Endpoint) Accept() (net.Conn, error) {
-	if atomic.LoadInt32(&e.state) == _S_EST0 {
-		return <-e.listenChan, nil
-	} else {
+	conn, err := e.AcceptContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// AcceptContext waits for the next connection, it returns ctx.Err()
+// once the ctx is done before any connection was accepted.
+func (e *Endpoint) AcceptContext(ctx context.Context) (*Conn, error) {
+	switch atomic.LoadInt32(&e.state) {
+	case _S_EST0:
+	case _S_FIN, _E_SHUTDOWN:
+		return nil, net.ErrClosed
+	default: // client
 		return nil, io.EOF
 	}
+	select {
+	case c := <-e.listenChan:
+		// release the place in backlog
+		<-e.backlog
+		return c, nil
+	case <-e.closing:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func (e *Endpoint) Listen() *Conn {
-	if atomic.LoadInt32(&e.state) == _S_EST0 {
-		return <-e.listenChan
-	} else {
-		return nil
-	}
+	conn, _ := e.AcceptContext(context.Background())
+	return conn
 }
 
 // tmo in MS
@@ -265,20 +678,14 @@ func (e *Endpoint) ListenTimeout(tmo int64) *Conn {
 	if tmo <= 0 {
 		return e.Listen()
 	}
-	if atomic.LoadInt32(&e.state) == _S_EST0 {
-		select {
-		case c := <-e.listenChan:
-			return c
-		case <-NewTimerChan(tmo):
-		}
-	}
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(tmo)*time.Millisecond)
+	defer cancel()
+	conn, _ := e.AcceptContext(ctx)
+	return conn
 }
 
 func (e *Endpoint) getConnID(idPtr *connID, buf []byte) {
-	// TODO determine magic header
-	magicAndLen := binary.BigEndian.Uint64(buf)
-	if int(magicAndLen&0xFFff) == len(buf) {
+	if isPacket(buf) {
 		id := binary.BigEndian.Uint64(buf[_MAGIC_SIZE+2:])
 		idPtr.lid = uint32(id >> 32)
 		idPtr.rid = uint32(id)
@@ -287,19 +694,22 @@ func (e *Endpoint) getConnID(idPtr *connID, buf []byte) {
 	}
 }
 
-func (e *Endpoint) dispatch(c *Conn, buf []byte) {
-	e.timeout.Reset(30)
+// the timer is owned by the reader
+func (e *Endpoint) dispatch(c *Conn, buf []byte, timeout *iTimer) {
+	timeout.Reset(30 * _MS)
 	select {
 	case c.evRecv <- buf:
-	case <-e.timeout.C:
+	case <-timeout.C:
 		log.Println("Warn: dispatch packet failed")
 	}
 }
 
-func (e *Endpoint) resetPeer(addr *net.UDPAddr, id connID) {
+// reply RESET through the shard which received the packet, or which the
+// conn writes to.
+func (e *Endpoint) resetPeer(shard int, addr net.Addr, id connID) {
 	pk := &packet{flag: _F_FIN | _F_RESET}
 	buf := nodeOf(pk).marshall(id)
-	e.udpconn.WriteToUDP(buf, addr)
+	e.socks[shard].WriteTo(buf, addr)
 }
 
 type u32Slice []uint32
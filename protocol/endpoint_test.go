@@ -1,10 +1,17 @@
 package suft
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"os"
+	"runtime"
 	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_insert_delete_rid(t *testing.T) {
@@ -40,3 +47,632 @@ func Test_insert_delete_rid(t *testing.T) {
 	}
 	assert(len(a) == 0, t, "a!=0")
 }
+
+func Test_dial_context_cancel(t *testing.T) {
+	// a peer never answers
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert(err == nil, t, "listen %v", err)
+	defer dead.Close()
+	e, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 1})
+	assert(err == nil, t, "endpoint %v", err)
+	defer e.Close()
+
+	d := &Dialer{Endpoint: e, Timeout: 200 * time.Millisecond}
+	t0 := time.Now()
+	conn, err := d.DialContext(context.Background(), dead.LocalAddr().String())
+	assert(conn == nil && err == context.DeadlineExceeded, t, "conn=%v err=%v", conn, err)
+	assert(time.Since(t0) < time.Second, t, "dial blocked %s", time.Since(t0))
+	e.mlock.RLock()
+	assert(len(e.lRegistry) == 0, t, "leaked conn")
+	e.mlock.RUnlock()
+}
+
+func Test_accept_context_cancel(t *testing.T) {
+	e, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 1, IsServ: true})
+	assert(err == nil, t, "endpoint %v", err)
+	defer e.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	conn, err := e.AcceptContext(ctx)
+	assert(conn == nil && err == context.Canceled, t, "conn=%v err=%v", conn, err)
+}
+
+func ctxTimeout(t testing.TB, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func Test_stateless_syn(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+
+	var id = connID{rid: 0, lid: 1234}
+	hi := &hello{token: 1, version: _VERSION, mss: _MSS, window: _MAX_SWND}
+	syn := nodeOf(&packet{flag: _F_SYN, payload: hi.marshall()}).marshall(id)
+	for i := 0; i < 100; i++ {
+		b.WriteTo(syn, a.addr)
+	}
+	buf := make([]byte, 1600)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := b.ReadFrom(buf)
+	assert(err == nil, t, "read %v", err)
+	var pk packet
+	unmarshall(&pk, buf[_TH_SIZE:n])
+	cookie := parseCookie(&pk)
+	assert(cookie != nil, t, "expected cookie %x", buf[:n])
+	serv.mlock.RLock()
+	assert(len(serv.lRegistry) == 0, t, "state was created before cookie")
+	serv.mlock.RUnlock()
+
+	assert(serv.checkCookie(b.addr, id.lid, cookie), t, "cookie")
+	assert(!serv.checkCookie(b.addr, id.lid+1, cookie), t, "cookie of another conn")
+	assert(!serv.checkCookie(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, id.lid, cookie), t, "cookie of another addr")
+}
+
+func Test_handshake_workers(t *testing.T) {
+	a, b := newPacketPipe()
+	// the ack3 of first one is lost, the acceptor is waiting it
+	b.setDrop(dropFirst(1, _F_ACK))
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true, HandshakeWorkers: 1})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	_, err = cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 1 %v", err)
+	c2, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 2 %v", err)
+	conn, err := serv.AcceptContext(ctxTimeout(t, time.Second))
+	assert(err == nil && conn.connID.rid == c2.connID.lid, t, "accept %v", err)
+}
+
+func Test_backlog_refused(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true, Backlog: 1})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	// nobody accepts, the first one is waiting in backlog
+	c1, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 1 %v", err)
+	c2, err := cli.Dial(a.addr.String())
+	assert(c2 == nil && err == ErrConnRefused, t, "dial 2 %v", err)
+	cli.mlock.RLock()
+	assert(len(cli.lRegistry) == 1, t, "leaked %d", len(cli.lRegistry))
+	cli.mlock.RUnlock()
+
+	conn, err := serv.AcceptContext(ctxTimeout(t, time.Second))
+	assert(err == nil && conn.connID.rid == c1.connID.lid, t, "accept %v", err)
+	// there is a place now
+	_, err = cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 3 %v", err)
+}
+
+func Test_shutdown(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var conns [3]*Conn
+	for i := range conns {
+		conns[i], err = cli.Dial(a.addr.String())
+		assert(err == nil, t, "dial %v", err)
+	}
+	c, err := serv.AcceptContext(ctxTimeout(t, time.Second))
+	assert(err == nil, t, "accept %v", err)
+	c.Write([]byte("bye"))
+
+	var done = make(chan error, 1)
+	go func() {
+		done <- serv.Shutdown(ctxTimeout(t, 5*time.Second))
+	}()
+	// the peers were closed gracefully
+	data, err := io.ReadAll(conns[0])
+	assert(err == nil && string(data) == "bye", t, "read %q %v", data, err)
+	for _, conn := range conns[1:] {
+		n, err := conn.Read(make([]byte, 1))
+		assert(n == 0 && err == io.EOF, t, "read %v", err)
+	}
+	assert(<-done == nil, t, "shutdown")
+	serv.mlock.RLock()
+	assert(len(serv.lRegistry) == 0, t, "conn leaked")
+	serv.mlock.RUnlock()
+	_, err = serv.Accept()
+	assert(err == net.ErrClosed, t, "accept after closed %v", err)
+}
+
+func Test_shutdown_half_closed(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, time.Second))
+	assert(err == nil, t, "accept %v", err)
+	assert(sc.CloseWrite() == nil, t, "close write")
+	var done = make(chan error, 1)
+	go func() {
+		done <- serv.Shutdown(ctxTimeout(t, 5*time.Second))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the peer is still sending, it isn't reset by Shutdown
+	_, err = conn.Write([]byte("tail"))
+	assert(err == nil, t, "write %v", err)
+	assert(conn.Close() == nil, t, "close")
+	data, err := io.ReadAll(sc)
+	assert(err == nil && string(data) == "tail", t, "read %q %v", data, err)
+	assert(<-done == nil, t, "shutdown")
+}
+
+func Test_shutdown_timeout(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	_, err = cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	c, err := serv.AcceptContext(ctxTimeout(t, time.Second))
+	assert(err == nil, t, "accept %v", err)
+	// the peer vanished
+	b.setDrop(func([]byte) bool { return true })
+
+	var read = make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	t0 := time.Now()
+	err = serv.Shutdown(ctxTimeout(t, 200*time.Millisecond))
+	assert(err == context.DeadlineExceeded, t, "shutdown %v", err)
+	assert(time.Since(t0) < time.Second, t, "shutdown blocked %s", time.Since(t0))
+	assert(<-read != nil, t, "blocked reader")
+	serv.mlock.RLock()
+	assert(len(serv.lRegistry) == 0, t, "conn leaked")
+	serv.mlock.RUnlock()
+}
+
+func Test_admission(t *testing.T) {
+	a, _ := newPacketPipe()
+	_, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, Deny: []string{"10.0.0.1"}})
+	assert(err != nil, t, "bad CIDR accepted")
+
+	var filtered int32
+	for i, p := range []*Params{
+		{Deny: []string{"127.0.0.0/8"}},
+		{Allow: []string{"10.0.0.0/8", "::1/128"}},
+		{AcceptFilter: func(addr *net.UDPAddr) bool {
+			atomic.AddInt32(&filtered, 1)
+			return addr.Port != 10002
+		}},
+	} {
+		p.Bandwidth, p.IsServ = 10, true
+		a, b := newPacketPipe()
+		serv, err := NewEndpointFromPacketConn(a, p)
+		assert(err == nil, t, "serv %v", err)
+		cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+		assert(err == nil, t, "cli %v", err)
+		c, err := cli.Dial(a.addr.String())
+		assert(c == nil && err == ErrConnRefused, t, "%d: dial %v", i, err)
+		serv.Close()
+		cli.Close()
+	}
+	assert(filtered == 1, t, "filter called %d", filtered)
+}
+
+func Test_max_conns(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true, MaxConnsPerIP: 2})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	c1, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 1 %v", err)
+	_, err = cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 2 %v", err)
+	_, err = cli.Dial(a.addr.String())
+	assert(err == ErrConnRefused, t, "dial 3 %v", err)
+
+	// closing one makes a place
+	conn, err := serv.AcceptContext(ctxTimeout(t, time.Second))
+	assert(err == nil, t, "accept %v", err)
+	conn.Close()
+	c1.Close()
+	for i := 0; ; i++ {
+		serv.mlock.RLock()
+		n := serv.admission.inbound
+		serv.mlock.RUnlock()
+		if n < 2 {
+			break
+		}
+		assert(i < 200, t, "not released")
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial 4 %v", err)
+}
+
+func Test_syn_rate(t *testing.T) {
+	adm, err := newAdmission(&Params{SynRate: 2})
+	assert(err == nil, t, "%v", err)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}
+	assert(adm.allowSyn(addr) && adm.allowSyn(addr), t, "burst")
+	assert(!adm.allowSyn(addr), t, "over rate")
+	assert(!adm.allowSyn(&net.UDPAddr{IP: addr.IP.To4(), Port: 2}), t, "same IP in 4 bytes")
+	assert(adm.allowSyn(other), t, "other IP")
+	time.Sleep(600 * time.Millisecond)
+	assert(adm.allowSyn(addr), t, "refilled")
+}
+
+func Test_shard_replies(t *testing.T) {
+	a0, b0 := newPacketPipe()
+	a1, b1 := newPacketPipe()
+	defer b0.Close()
+	defer b1.Close()
+	e, err := newEndpoint([]net.PacketConn{a0, a1}, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "%v", err)
+	defer e.Close()
+
+	// the SYN without cookie and the packet of unknown conn arrived on shard 1
+	hi := &hello{token: 7, version: _VERSION, mss: 1200, window: 64}
+	e.handlePacket(1, nodeOf(&packet{flag: _F_SYN, payload: hi.marshall()}).marshall(connID{7, 0}), b1.addr, nil)
+	e.handlePacket(1, nodeOf(&packet{flag: _F_ACK}).marshall(connID{7, 12345}), b1.addr, nil)
+	for _, flag := range []byte{_F_CTRL, _F_FIN | _F_RESET} {
+		select {
+		case p := <-b1.in:
+			assert(p.data[_TH_SIZE+8] == flag, t, "reply %x", p.data[_TH_SIZE+8])
+		case <-time.After(time.Second):
+			t.Fatal("no reply by shard 1")
+		}
+	}
+	select {
+	case <-b0.in:
+		t.Fatal("replied by shard 0")
+	default:
+	}
+}
+
+func Test_conns(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err = cli.Dial(a.addr.String())
+		assert(err == nil, t, "dial %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = serv.AcceptContext(ctxTimeout(t, time.Second))
+		assert(err == nil, t, "accept %v", err)
+	}
+	infos := serv.Conns()
+	assert(len(infos) == 2 && infos[0].LocalID < infos[1].LocalID, t, "conns %v", infos)
+	for _, info := range infos {
+		assert(info.State == "ESTABLISHED" && info.Age >= 0, t, "info %+v", info)
+		assert(sameAddr(info.Remote, b.addr), t, "remote %v", info.Remote)
+		c := cli.ConnByID(info.RemoteID)
+		assert(c != nil && c.connID.rid == info.LocalID, t, "peer of %d", info.LocalID)
+	}
+	c := serv.ConnByID(infos[0].LocalID)
+	assert(c == infos[0].Conn, t, "by id")
+	c.Close()
+	assert(serv.ConnByID(0) == nil, t, "by id 0")
+}
+
+func Test_conns_dialing(t *testing.T) {
+	a, b := newPacketPipe()
+	// nobody answers
+	b.setDrop(func([]byte) bool { return true })
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	go cli.DialContext(ctxTimeout(t, time.Second), a.addr.String())
+	for i := 0; ; i++ {
+		if infos := cli.Conns(); len(infos) == 1 {
+			info := infos[0]
+			assert(info.RemoteID == 0 && info.State == "SYN_SENT", t, "info %+v", info)
+			break
+		}
+		assert(i < 100, t, "not dialing")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_families(t *testing.T) {
+	for _, c := range []struct {
+		network, addr string
+		v4, v6        bool
+	}{
+		{"", ":0", true, true},
+		{"", "127.0.0.1:0", true, false},
+		{"", "[::1]:0", false, true},
+		{"udp6", "[::]:0", false, true},
+		{"udp4", ":0", true, false},
+	} {
+		e, err := NewEndpoint(&Params{Network: c.network, LocalAddr: c.addr, Bandwidth: 1})
+		if err != nil {
+			t.Logf("%s: %v", c.addr, err)
+			continue
+		}
+		v4, v6 := e.families()
+		assert(v4 == c.v4 && v6 == c.v6, t, "%s: %v %v", c.addr, v4, v6)
+		e.Close()
+	}
+	a4 := []net.Addr{&net.UDPAddr{Port: 4}, &net.UDPAddr{Port: 5}}
+	a6 := []net.Addr{&net.UDPAddr{Port: 6}}
+	all := interleave(a6, a4)
+	assert(len(all) == 3 && all[0] == a6[0] && all[1] == a4[0] && all[2] == a4[1], t, "%v", all)
+}
+
+func Test_happy_eyeballs(t *testing.T) {
+	serv, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	// it never answers
+	hole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert(err == nil, t, "hole %v", err)
+	defer hole.Close()
+	cli, err := NewEndpoint(&Params{LocalAddr: ":0", Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	t0 := time.Now()
+	conn, err := cli.dialParallel(ctxTimeout(t, 3*time.Second), []net.Addr{hole.LocalAddr(), serv.Addr()})
+	assert(err == nil, t, "dial %v", err)
+	d := time.Since(t0)
+	assert(d >= _ATTEMPT_DELAY && d < time.Second, t, "dialed after %s", d)
+	assert(sameAddr(conn.RemoteAddr(), serv.Addr()), t, "winner %v", conn.RemoteAddr())
+	// the loser was canceled
+	for i := 0; ; i++ {
+		cli.mlock.RLock()
+		n := len(cli.lRegistry)
+		cli.mlock.RUnlock()
+		if n == 1 {
+			break
+		}
+		assert(i < 100, t, "loser leaked")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// hostname
+	_, port, _ := net.SplitHostPort(serv.Addr().String())
+	conn, err = cli.Dial(net.JoinHostPort("localhost", port))
+	assert(err == nil, t, "dial localhost %v", err)
+}
+
+func Test_unixgram(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram")
+	}
+	path := tempSockPath()
+	serv, err := NewEndpoint(&Params{LocalAddr: path, Network: "unixgram", Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpoint(&Params{Network: "unixgram", Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	cliPath := cli.sockPath
+
+	done := make(chan []byte, 1)
+	go func() {
+		conn, err := serv.Accept()
+		if err != nil {
+			done <- nil
+			return
+		}
+		b, _ := io.ReadAll(conn)
+		done <- b
+	}()
+	conn, err := cli.Dial(path)
+	assert(err == nil, t, "dial %v", err)
+	data := make([]byte, 100e3)
+	rand.Read(data)
+	_, err = conn.Write(data)
+	assert(err == nil, t, "write %v", err)
+	assert(conn.Close() == nil, t, "close")
+	select {
+	case b := <-done:
+		assert(string(b) == string(data), t, "received %d bytes", len(b))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	cli.Close()
+	_, err = os.Stat(cliPath)
+	assert(os.IsNotExist(err), t, "socket file left %v", err)
+}
+
+func Test_hello(t *testing.T) {
+	hi := &hello{token: 7, version: _VERSION, mss: 1200, window: 64, features: 3, rbuf: 8 << 10}
+	b := appendCookie(hi.marshall(), make([]byte, _COOKIE_SIZE))
+	b = append(b, 0xfe, 2, 0, 0) // unknown option is skipped
+	var h hello
+	assert(h.unmarshall(b), t, "unmarshall %x", b)
+	assert(h.token == 7 && h.version == _VERSION && h.mss == 1200 && h.window == 64 &&
+		h.features == 3 && h.rbuf == 8<<10 && len(h.cookie) == _COOKIE_SIZE, t, "hello %+v", h)
+	assert(h.reject() == 0, t, "rejected")
+
+	assert(!h.unmarshall(b[:len(b)-1]), t, "truncated option")
+	assert(!h.unmarshall([]byte{0, 0, 0, 0, 0, 0, 0, 7, _VERSION, _O_MSS, 1, 0}), t, "bad mss")
+	// absent options are defaults
+	assert(h.unmarshall(b[:_TOKEN_SIZE+1]) && h.mss == _MSS && h.window == _MAX_SWND, t, "defaults %+v", h)
+
+	h.version = _MIN_VERSION - 1
+	assert(h.reject() == _R_VERSION, t, "old version")
+	h.version = _VERSION + 1
+	assert(h.reject() == 0 && negotiateVersion(h.version) == _VERSION, t, "new version")
+	h.mss = _MIN_MSS - 1
+	assert(h.reject() == _R_CAPS, t, "small mss")
+}
+
+func Test_version_mismatch(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+
+	// the acceptor refuses the unsupported version after the cookie
+	var id = connID{rid: 0, lid: 1234}
+	hi := &hello{token: 1, version: _MIN_VERSION - 1, mss: _MSS, window: _MAX_SWND}
+	b.WriteTo(nodeOf(&packet{flag: _F_SYN, payload: hi.marshall()}).marshall(id), a.addr)
+	buf := make([]byte, 1600)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := b.ReadFrom(buf)
+	assert(err == nil, t, "read %v", err)
+	var pk packet
+	unmarshall(&pk, buf[_TH_SIZE:n])
+	hi.cookie = parseCookie(&pk)
+	assert(hi.cookie != nil, t, "expected cookie %x", buf[:n])
+	b.WriteTo(nodeOf(&packet{flag: _F_SYN, payload: hi.marshall()}).marshall(id), a.addr)
+	n, _, err = b.ReadFrom(buf)
+	assert(err == nil, t, "read %v", err)
+	unmarshall(&pk, buf[_TH_SIZE:n])
+	assert(pk.flag&_F_RESET != 0 && resetError(pk.payload) == ErrVersionMismatch, t, "reply %x", buf[:n])
+
+	// the peer before the magic
+	hi = &hello{token: 1, version: _VERSION, mss: _MSS, window: _MAX_SWND}
+	syn := nodeOf(&packet{flag: _F_SYN, payload: hi.marshall()}).marshall(id)
+	copy(syn, make([]byte, _MAGIC_SIZE))
+	b.WriteTo(syn, a.addr)
+	n, _, err = b.ReadFrom(buf)
+	assert(err == nil, t, "read %v", err)
+	unmarshall(&pk, buf[_TH_SIZE:n])
+	assert(pk.flag&_F_RESET != 0 && resetError(pk.payload) == ErrVersionMismatch, t, "legacy reply %x", buf[:n])
+	var rid connID
+	serv.getConnID(&rid, buf[:n])
+	assert(rid.lid == id.lid, t, "reply to %v", rid)
+
+	// other foreign packets are not answered
+	b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	syn[_MAGIC_SIZE+1]++
+	b.WriteTo(syn, a.addr)
+	_, _, err = b.ReadFrom(buf)
+	assert(err != nil, t, "replied to foreign packet")
+	b.Close()
+
+	// the dialer gets the explicit error
+	c, d := newPacketPipe()
+	cli, err := NewEndpointFromPacketConn(c, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+	go func() {
+		n, _, err := d.ReadFrom(buf)
+		if err == nil {
+			var id connID
+			cli.getConnID(&id, buf[:n])
+			rst := &packet{flag: _F_FIN | _F_RESET, payload: []byte{_R_VERSION, _VERSION + 1}}
+			d.WriteTo(nodeOf(rst).marshall(connID{rid: id.rid, lid: 99}), c.addr)
+		}
+	}()
+	conn, err := cli.DialContext(ctxTimeout(t, 3*time.Second), d.addr.String())
+	assert(conn == nil && err == ErrVersionMismatch, t, "dial %v", err)
+}
+
+func Test_fallback_handler(t *testing.T) {
+	serv, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	// echo the foreign datagrams
+	serv.SetFallbackHandler(func(pkt []byte, from *net.UDPAddr) {
+		serv.WriteTo(append([]byte("echo "), pkt...), from)
+	})
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert(err == nil, t, "raw %v", err)
+	defer raw.Close()
+
+	buf := make([]byte, 1600)
+	for _, msg := range []string{"hi", "a longer datagram than the header of protocol"} {
+		raw.WriteTo([]byte(msg), serv.Addr())
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := raw.ReadFrom(buf)
+		assert(err == nil && string(buf[:n]) == "echo "+msg, t, "echo %q %v", buf[:n], err)
+	}
+
+	// the protocol works on the same port
+	cli, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+	go serv.Accept()
+	conn, err := cli.Dial(serv.Addr().String())
+	assert(err == nil, t, "dial %v", err)
+	conn.Close()
+
+	assert(isPacket(nodeOf(&packet{flag: _F_ACK}).marshall(connID{})), t, "packet")
+	assert(!isPacket(make([]byte, _AH_SIZE)), t, "zeros")
+}
+
+func Test_jumbo_mtu(t *testing.T) {
+	serv, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10, IsServ: true, Mtu: 9000})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10, Mtu: 9000})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+	small, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10})
+	assert(err == nil, t, "small %v", err)
+	defer small.Close()
+	_, err = NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10, Mtu: 100})
+	assert(err != nil, t, "mtu 100")
+
+	done := make(chan int)
+	go func() {
+		for {
+			conn, err := serv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b, _ := io.ReadAll(conn)
+				done <- len(b)
+			}()
+		}
+	}()
+	conn, err := cli.Dial(serv.Addr().String())
+	assert(err == nil, t, "dial %v", err)
+	assert(conn.maxMss == 9000-_UDP4_HDR-_AH_SIZE, t, "max mss %d", conn.maxMss)
+	mss := waitPmtu(t, conn)
+	assert(mss == conn.maxMss, t, "mss %d", mss)
+	data := make([]byte, 1<<20)
+	go func() {
+		conn.Write(data)
+		conn.Close()
+	}()
+	select {
+	case n := <-done:
+		assert(n == len(data), t, "received %d", n)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// the smaller one is agreed
+	conn, err = small.Dial(serv.Addr().String())
+	assert(err == nil, t, "dial %v", err)
+	assert(conn.maxMss == _MSS && waitPmtu(t, conn) == _MSS, t, "mss %d/%d", conn.mss, conn.maxMss)
+	conn.Close()
+}
@@ -0,0 +1,165 @@
+package suft
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Happy eyeballs (RFC 8305)
+//
+// A hostname is resolved to all of its addresses which the endpoint could
+// reach, ordered by alternating the families, IPv6 first. The attempts are
+// started one by one every _ATTEMPT_DELAY, or at once when the previous one
+// failed. The first established connection wins, the others are canceled
+// and reset.
+const _ATTEMPT_DELAY = 250 * time.Millisecond
+
+type dialResult struct {
+	conn *Conn
+	err  error
+}
+
+// the families of peer could be reached by the socket
+func (e *Endpoint) families() (v4, v6 bool) {
+	la := e.sock.LocalAddr()
+	switch e.network() {
+	case "udp4":
+		return true, false
+	case "udp6":
+		return false, true
+	}
+	ua, _ := la.(*net.UDPAddr)
+	switch {
+	case ua == nil || ua.IP == nil || ua.IP.Equal(net.IPv6unspecified):
+		// dual-stack
+		return true, true
+	case ua.IP.To4() != nil:
+		return true, false
+	default:
+		return false, true
+	}
+}
+
+func (e *Endpoint) resolveCandidates(ctx context.Context, addr string) ([]net.Addr, error) {
+	network := e.network()
+	if !strings.HasPrefix(network, "udp") { // socket path
+		rAddr, err := e.resolveAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Addr{rAddr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// ip literal, with zone perhaps
+	h := host
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		h = host[:i]
+	}
+	if host == "" || net.ParseIP(h) != nil {
+		rAddr, err := e.resolveAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Addr{rAddr}, nil
+	}
+	pn, err := net.DefaultResolver.LookupPort(ctx, network, port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	v4ok, v6ok := e.families()
+	var v4, v6 []net.Addr
+	for _, ip := range ips {
+		ua := &net.UDPAddr{IP: ip.IP, Port: pn, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			if v4ok {
+				v4 = append(v4, ua)
+			}
+		} else if v6ok {
+			v6 = append(v6, ua)
+		}
+	}
+	cands := interleave(v6, v4)
+	if len(cands) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return cands, nil
+}
+
+func interleave(first, second []net.Addr) []net.Addr {
+	all := make([]net.Addr, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			all = append(all, first[i])
+		}
+		if i < len(second) {
+			all = append(all, second[i])
+		}
+	}
+	return all
+}
+
+func (e *Endpoint) dialParallel(ctx context.Context, cands []net.Addr) (*Conn, error) {
+	actx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(cands))
+	var next, pending int
+	var firstErr error
+	start := func() {
+		addr := cands[next]
+		next++
+		pending++
+		go func() {
+			c, err := e.dialAddr(actx, addr)
+			results <- dialResult{c, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(_ATTEMPT_DELAY)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				go resetLosers(results, pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			// the previous one failed, don't wait
+			if next < len(cands) {
+				start()
+				timer.Reset(_ATTEMPT_DELAY)
+			}
+		case <-timer.C:
+			if next < len(cands) {
+				start()
+				timer.Reset(_ATTEMPT_DELAY)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, firstErr
+}
+
+// the attempts completed after the winner are reset
+func resetLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.err == nil {
+			r.conn.hardReset(context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package suft
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Sharing the port with other protocols
+//
+// The datagrams are classified by the magic and length of header, the
+// others are given to the fallback handler, eg. STUN, DNS or any legacy
+// protocol on the same port, which could answer them by Endpoint.WriteTo.
+// They are dropped if no handler was set.
+
+// whether the datagram is a packet of this protocol
+func isPacket(buf []byte) bool {
+	return len(buf) >= _AH_SIZE && string(buf[:_MAGIC_SIZE]) == _MAGIC &&
+		int(binary.BigEndian.Uint16(buf[_MAGIC_SIZE:])) == len(buf)
+}
+
+// SetFallbackHandler sets the handler of foreign datagrams, nil to drop them.
+// It's called in the reading goroutine, so it should not block, and the pkt
+// is owned by the handler.
+func (e *Endpoint) SetFallbackHandler(fn func(pkt []byte, from *net.UDPAddr)) {
+	e.fallback.Store(fn)
+}
+
+// WriteTo writes a raw datagram through the socket of Endpoint, bypassing
+// the protocol, to answer the datagrams given to the fallback handler.
+func (e *Endpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return e.sock.WriteTo(b, addr)
+}
+
+func (e *Endpoint) handleForeign(buf []byte, addr net.Addr) {
+	fn, _ := e.fallback.Load().(func([]byte, *net.UDPAddr))
+	if ua, y := addr.(*net.UDPAddr); y && fn != nil {
+		fn(buf, ua)
+	} else if debug >= 1 {
+		dumpb("drop foreign", buf)
+	}
+}
@@ -0,0 +1,104 @@
+package suft
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Receiver flow control
+//
+// The receiver buffers at most Params.RecvBuffer bytes for the reader,
+// and advertises the right edge of its window, which is the largest seq
+// could be accepted, by the trailer of ACK and SACK. The edge never goes
+// back, the data after it are dropped. The sender keeps the packets in
+// flight within both cwnd and the window, and probes the closed window
+// by the keepalive probe until it's opened, because the update may be
+// lost. The initial window is the one of handshake.
+//
+//	ACK:  WND:4
+//	SACK: TBL:1 | SCNT:1 | DELAY:4 | bitmap | WND:4
+const (
+	_RECV_BUFFER = 4 << 20
+	_WND_SIZE    = 4
+)
+
+// the window in packets of whole buffer
+func (c *Conn) recvWindow() int32 {
+	w := int32(c.rbufLimit / c.maxMss)
+	return maxI32(minI32(w, _MAX_SWND), _MIN_SWND)
+}
+
+func (c *Conn) rwndEnabled() bool {
+	return c.features&_FEAT_RWND != 0
+}
+
+// the current right edge of window, must in inlock
+func (c *Conn) recvEdge() uint32 {
+	// the continuous data which has not been read
+	used := len(c.inQReady) + int(seqDiff(c.inQ.maxCtnSeq, c.lastReadSeq))*c.maxMss
+	free := maxI(c.rbufLimit-used, 0) / c.maxMss
+	return seqMax(c.rcvEdge, c.inQ.maxCtnSeq+uint32(free))
+}
+
+// append the window to payload of ACK or SACK, must in inlock
+func (c *Conn) appendWindow(payload []byte) []byte {
+	if !c.rwndEnabled() {
+		return payload
+	}
+	var b [_WND_SIZE]byte
+	c.rcvEdge = c.recvEdge()
+	binary.BigEndian.PutUint32(b[:], c.rcvEdge)
+	return append(payload, b[:]...)
+}
+
+// the window opened by reading enough, then tell the sender, must in inlock
+func (c *Conn) windowOpened() bool {
+	if !c.rwndEnabled() {
+		return false
+	}
+	return seqDiff(c.recvEdge(), c.rcvEdge) >= maxI32(c.recvWindow()>>2, 1)
+}
+
+// tell the sender the window was opened by reading
+func (c *Conn) notifyWindow() {
+	select {
+	case c.evAck <- _VACK_MUST:
+	default:
+	}
+}
+
+// parse the window of ACK or SACK
+func parseWindow(pk *packet) (edge uint32, ok bool) {
+	n := len(pk.payload)
+	if pk.flag&_F_SACK != 0 {
+		ok = n > _SACK_HEAD && (n-_SACK_HEAD)&7 == _WND_SIZE
+	} else {
+		ok = n == _WND_SIZE
+	}
+	if ok {
+		edge = binary.BigEndian.Uint32(pk.payload[n-_WND_SIZE:])
+	}
+	return
+}
+
+// must in outlock
+func (c *Conn) updateSendEdge(pk *packet) {
+	if !c.rwndEnabled() {
+		return
+	}
+	if edge, ok := parseWindow(pk); ok && seqAfter(edge, c.sndEdge) {
+		c.sndEdge = edge
+		select {
+		case c.evSend <- 1:
+		default:
+		}
+	}
+}
+
+// the count of packets could be sent by the window, must in outlock
+func (c *Conn) sendWindow() int32 {
+	if !c.rwndEnabled() {
+		return math.MaxInt32
+	}
+	return maxI32(seqDiff(c.sndEdge, c.mySeq), 0)
+}
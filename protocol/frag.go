@@ -0,0 +1,110 @@
+package suft
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Fragments of the oversized packet
+//
+// The packets in outQ were built by the MSS of the path they were sent,
+// if the connection was migrated to a path with smaller MTU, they are
+// re-split into fragments while retransmitting. The fragments share the
+// seq and flags of the packet, then the receiver reassembles them before
+// inserting the packet, so the seq space isn't changed.
+//
+//	fragment: OFF:2 | SIZE:2 | data
+const (
+	_FRAG_HEAD = 4
+	_MAX_FRAGS = 64 // packets being reassembled
+)
+
+type fragment struct {
+	buf  []byte
+	bits []uint64 // received bytes
+	got  int
+}
+
+// split the packet larger than the path, return nil if it isn't required.
+func (c *Conn) splitWrite(item *qNode) (bufs [][]byte) {
+	mss := int(atomic.LoadInt32(&c.mss))
+	if len(item.payload) <= mss || c.features&_FEAT_FRAG == 0 {
+		return nil
+	}
+	step := mss - _FRAG_HEAD
+	for off := 0; off < len(item.payload); off += step {
+		end := minI(off+step, len(item.payload))
+		payload := make([]byte, _FRAG_HEAD+end-off)
+		binary.BigEndian.PutUint16(payload, uint16(off))
+		binary.BigEndian.PutUint16(payload[2:], uint16(len(item.payload)))
+		copy(payload[_FRAG_HEAD:], item.payload[off:end])
+		pk := &packet{
+			seq:     item.seq,
+			ack:     item.ack,
+			flag:    item.flag | _F_FRAG,
+			scnt:    item.scnt,
+			payload: payload,
+		}
+		bufs = append(bufs, pk.marshall(c.connID))
+	}
+	return
+}
+
+// called by internalRecvLoop, return the whole packet if all fragments
+// were received, or nil if waiting more.
+func (c *Conn) reassemble(pk *packet) *packet {
+	if len(pk.payload) < _FRAG_HEAD {
+		return nil
+	}
+	off := int(binary.BigEndian.Uint16(pk.payload))
+	size := int(binary.BigEndian.Uint16(pk.payload[2:]))
+	data := pk.payload[_FRAG_HEAD:]
+	if size == 0 || size > c.edp.rsize-_AH_SIZE || off+len(data) > size {
+		return nil
+	}
+	c.inlock.Lock()
+	received := c.inQ.contains(pk.seq) || !seqAfter(pk.seq, c.inQ.maxCtnSeq)
+	maxCtnSeq := c.inQ.maxCtnSeq
+	c.inlock.Unlock()
+	if received {
+		// reply the ack as the duplicated
+		return pk
+	}
+	if c.frags == nil {
+		c.frags = make(map[uint32]*fragment)
+	}
+	f := c.frags[pk.seq]
+	if f == nil {
+		for seq := range c.frags {
+			if !seqAfter(seq, maxCtnSeq) {
+				delete(c.frags, seq)
+			}
+		}
+		if len(c.frags) >= _MAX_FRAGS {
+			return nil
+		}
+		f = &fragment{buf: bpool.Get(size)[:size], bits: make([]uint64, (size+63)>>6)}
+		c.frags[pk.seq] = f
+	} else if len(f.buf) != size {
+		return nil
+	}
+	copy(f.buf[off:], data)
+	for i := off; i < off+len(data); i++ {
+		if f.bits[i>>6]&(1<<uint(i&63)) == 0 {
+			f.bits[i>>6] |= 1 << uint(i&63)
+			f.got++
+		}
+	}
+	if f.got < size {
+		return nil
+	}
+	delete(c.frags, pk.seq)
+	return &packet{
+		seq:     pk.seq,
+		ack:     pk.ack,
+		flag:    pk.flag &^ _F_FRAG,
+		scnt:    pk.scnt,
+		payload: f.buf,
+		buffer:  f.buf,
+	}
+}
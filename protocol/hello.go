@@ -0,0 +1,233 @@
+package suft
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+)
+
+// Version and capability negotiation
+//
+// The SYN and SYN+ACK carry the protocol version and a TLV list of the
+// capabilities following the token of migration. Both sides use the lower
+// version and the common capabilities, so the acceptor replies the chosen
+// version and the dialer refuses the version it doesn't support. Unknown
+// options are skipped, then new ones can be added without a new version.
+//
+//	hello:  TOKEN:8 | VER:1 | option...
+//	option: TYPE:1 | LEN:1 | VALUE:LEN
+//
+// The SYN refused for the version or capabilities is answered by RESET
+// with the reason once its cookie was verified, then the dialer gets an
+// explicit error. The peers before the magic can't do the cookie, their
+// SYN is answered by the version RESET directly, see isLegacySyn.
+//
+//	RESET:  REASON:1 | VER:1
+const (
+	_VERSION     = 1
+	_MIN_VERSION = 1
+)
+
+// types of option
+const (
+	_O_MSS      = iota + 1 // MSS:2, the largest payload could be received
+	_O_WINDOW              // WND:4, the max packets in flight could be received
+	_O_FEATURES            // BITS:4
+	_O_COOKIE              // COOKIE:16, in SYN only
+	_O_RBUF                // BYTES:4, the receive buffer
+)
+
+// bits of the optional features
+const (
+	_FEAT_PMTUD = 1 << iota // probing the path MTU
+	_FEAT_RWND              // advertised receive window
+	_FEAT_DGRAM             // unreliable datagrams
+	_FEAT_FRAG              // fragments of the oversized packet
+	_FEAT_MSG               // message boundaries by EOR
+)
+
+const _FEATURES uint32 = _FEAT_PMTUD | _FEAT_RWND | _FEAT_DGRAM | _FEAT_FRAG | _FEAT_MSG
+
+// reasons of RESET
+const (
+	_R_VERSION = iota + 1
+	_R_CAPS
+)
+
+const _MIN_MSS = 256
+
+var (
+	ErrVersionMismatch = errors.New("Protocol version mismatch")
+	ErrIncompatible    = errors.New("Incompatible capabilities")
+)
+
+type hello struct {
+	token    uint64
+	version  uint8
+	mss      int
+	window   int32
+	features uint32
+	rbuf     int
+	cookie   []byte
+}
+
+func (h *hello) marshall() []byte {
+	const size = _TOKEN_SIZE + 1 + 4 + 6 + 6 + 6
+	b := make([]byte, size, size+2+_COOKIE_SIZE)
+	binary.BigEndian.PutUint64(b, h.token)
+	b[_TOKEN_SIZE] = h.version
+	o := b[_TOKEN_SIZE+1:]
+	o[0], o[1] = _O_MSS, 2
+	binary.BigEndian.PutUint16(o[2:], uint16(h.mss))
+	o[4], o[5] = _O_WINDOW, 4
+	binary.BigEndian.PutUint32(o[6:], uint32(h.window))
+	o[10], o[11] = _O_FEATURES, 4
+	binary.BigEndian.PutUint32(o[12:], h.features)
+	o[16], o[17] = _O_RBUF, 4
+	binary.BigEndian.PutUint32(o[18:], uint32(h.rbuf))
+	if h.cookie != nil {
+		b = appendCookie(b, h.cookie)
+	}
+	return b
+}
+
+func appendCookie(b, cookie []byte) []byte {
+	b = append(b, _O_COOKIE, _COOKIE_SIZE)
+	return append(b, cookie...)
+}
+
+// parse without allocating, the absent options are defaults.
+func (h *hello) unmarshall(payload []byte) bool {
+	if len(payload) < _TOKEN_SIZE+1 {
+		return false
+	}
+	*h = hello{
+		token:   binary.BigEndian.Uint64(payload),
+		version: payload[_TOKEN_SIZE],
+		mss:     _MSS,
+		window:  _MAX_SWND,
+	}
+	opts := payload[_TOKEN_SIZE+1:]
+	for len(opts) > 0 {
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return false
+		}
+		typ, val := opts[0], opts[2:2+opts[1]]
+		opts = opts[2+len(val):]
+		switch {
+		case typ == _O_MSS && len(val) == 2:
+			h.mss = int(binary.BigEndian.Uint16(val))
+		case typ == _O_WINDOW && len(val) == 4:
+			h.window = int32(minI64(int64(binary.BigEndian.Uint32(val)), _MAX_SWND))
+		case typ == _O_FEATURES && len(val) == 4:
+			h.features = binary.BigEndian.Uint32(val)
+		case typ == _O_COOKIE && len(val) == _COOKIE_SIZE:
+			h.cookie = val
+		case typ == _O_RBUF && len(val) == 4:
+			h.rbuf = int(minI64(int64(binary.BigEndian.Uint32(val)), math.MaxInt32))
+		case typ <= _O_RBUF:
+			return false // known but malformed
+		}
+	}
+	return true
+}
+
+// the version used with the peer, or 0 if unsupported
+func negotiateVersion(peer uint8) uint8 {
+	v := peer
+	if v > _VERSION {
+		v = _VERSION
+	}
+	if v < _MIN_VERSION {
+		return 0
+	}
+	return v
+}
+
+func (h *hello) compatible() bool {
+	return h.mss >= _MIN_MSS && h.window >= _MIN_SWND
+}
+
+// check the reason of refused SYN
+func (h *hello) reject() (reason byte) {
+	if negotiateVersion(h.version) == 0 {
+		return _R_VERSION
+	} else if !h.compatible() {
+		return _R_CAPS
+	}
+	return 0
+}
+
+func (c *Conn) myHello() *hello {
+	return &hello{
+		token:    c.path.token,
+		version:  c.version,
+		mss:      c.maxMss,
+		window:   c.recvWindow(),
+		features: _FEATURES,
+		rbuf:     c.rbufLimit,
+	}
+}
+
+// apply the hello of peer, called while handshaking
+func (c *Conn) applyHello(payload []byte) error {
+	var h hello
+	if !h.unmarshall(payload) {
+		return ErrInexplicableData
+	}
+	switch h.reject() {
+	case _R_VERSION:
+		return ErrVersionMismatch
+	case _R_CAPS:
+		return ErrIncompatible
+	}
+	c.setPeerToken(payload)
+	c.version = negotiateVersion(h.version)
+	c.maxMss = minI(c.maxMss, h.mss)
+	c.peerWnd = h.window
+	c.peerRbuf = h.rbuf
+	c.features = _FEATURES & h.features
+	c.initPmtu()
+	return nil
+}
+
+func (e *Endpoint) rejectSyn(shard int, addr net.Addr, id connID, reason byte) {
+	pk := &packet{flag: _F_FIN | _F_RESET, payload: []byte{reason, _VERSION}}
+	e.socks[shard].WriteTo(nodeOf(pk).marshall(id), addr)
+	if debug >= 1 {
+		log.Println("refused", addr, "reason", reason)
+	}
+}
+
+// a SYN of the peer before the magic, which has the same header but the
+// first bytes. It's not a foreign datagram for the fallback handler.
+func isLegacySyn(buf []byte) bool {
+	return len(buf) >= _AH_SIZE && string(buf[:_MAGIC_SIZE]) != _MAGIC &&
+		int(binary.BigEndian.Uint16(buf[_MAGIC_SIZE:])) == len(buf) &&
+		binary.BigEndian.Uint32(buf[_MAGIC_SIZE+2:]) == 0 && buf[_TH_SIZE+8] == _F_SYN
+}
+
+// the RESET isn't larger than the SYN, and limited by the rate of SYN.
+func (e *Endpoint) rejectLegacySyn(shard int, buf []byte, addr net.Addr) {
+	if !e.isServ || !e.admission.permitted(addr) || !e.admission.allowSyn(addr) {
+		dumpb("drop legacy syn", buf)
+		return
+	}
+	id := connID{rid: binary.BigEndian.Uint32(buf[_MAGIC_SIZE+6:])}
+	e.rejectSyn(shard, addr, id, _R_VERSION)
+}
+
+// the error of RESET replied to SYN
+func resetError(payload []byte) error {
+	if len(payload) > 0 {
+		switch payload[0] {
+		case _R_VERSION:
+			return ErrVersionMismatch
+		case _R_CAPS:
+			return ErrIncompatible
+		}
+	}
+	return ErrConnRefused
+}
@@ -0,0 +1,159 @@
+package suft
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_KEEPALIVE_PERIOD = 15e6 // us
+	// unanswered probes before the connection is torn down
+	_KEEPALIVE_PROBES = 3
+)
+
+// SetKeepAlive enables or disables sending keepalive probes while
+// the connection is idle. The peer vanished will be detected after
+// several unanswered probes, then the connection will be torn down.
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	var period int64
+	if keepalive {
+		period = _KEEPALIVE_PERIOD
+	}
+	atomic.StoreInt64(&c.kaPeriod, period)
+	c.notifyKeepAlive()
+	return nil
+}
+
+// SetKeepAlivePeriod sets period between keepalive probes,
+// and enables keepalive.
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	atomic.StoreInt64(&c.kaPeriod, maxI64(int64(d/time.Microsecond), 1))
+	c.notifyKeepAlive()
+	return nil
+}
+
+// SetIdleTimeout sets the max duration of receiving nothing from the peer,
+// then the connection will be torn down. Zero means no timeout.
+func (c *Conn) SetIdleTimeout(d time.Duration) error {
+	var tmo int64
+	if d > 0 {
+		tmo = maxI64(int64(d/time.Microsecond), 1)
+	}
+	atomic.StoreInt64(&c.idleTmo, tmo)
+	c.notifyKeepAlive()
+	return nil
+}
+
+func (c *Conn) notifyKeepAlive() {
+	select {
+	case c.evKeep <- 1:
+	default:
+	}
+}
+
+// called by internalAckLoop, return the delay of next check, 0 means no check.
+func (c *Conn) checkAlive() int64 {
+	period := atomic.LoadInt64(&c.kaPeriod)
+	idle := atomic.LoadInt64(&c.idleTmo)
+	if period <= 0 && idle <= 0 {
+		return 0
+	}
+	silent := Now() - atomic.LoadInt64(&c.lastRecv)
+	if (idle > 0 && silent >= idle) || (period > 0 && silent >= period*(_KEEPALIVE_PROBES+1)) {
+		// can't shutdown in the ack loop
+		go c.abort(ErrIOTimeout)
+		return 0
+	}
+	var next int64 = idle - silent
+	if period > 0 {
+		if silent >= period {
+			c.sendProbe()
+			next = period
+		} else {
+			next = period - silent
+		}
+		if idle > 0 {
+			next = minI64(next, idle-silent)
+		}
+	}
+	return next
+}
+
+// the probe is a duplicated ack with SYN, like the syn+ack of handshake was resent,
+// and the peer will reply its last ack.
+func (c *Conn) sendProbe() {
+	c.inlock.Lock()
+	pk := &packet{
+		ack:  seqMax(c.lastAck, c.inQ.maxCtnSeq),
+		flag: _F_ACK | _F_SYN,
+	}
+	c.internalWrite(nodeOf(pk))
+	c.inlock.Unlock()
+}
+
+type connErr struct{ error }
+
+func (c *Conn) setErr(err error) {
+	c.err.Store(connErr{err})
+}
+
+func (c *Conn) isAborted() bool {
+	return atomic.LoadInt32(&c.aborted) != 0
+}
+
+// tear down the connection and reset the peer, blocked Read/Write will
+// get the err.
+func (c *Conn) abort(err error) {
+	c.teardown(err, true)
+}
+
+// tear down the connection in any state but _S_FIN, the peer isn't reset
+// if it was the one resetting us.
+func (c *Conn) teardown(err error, reset bool) {
+	c.outlock.Lock()
+	if atomic.LoadInt32(&c.state) == _S_FIN {
+		c.outlock.Unlock()
+		return
+	}
+	if err != nil {
+		c.setErr(err)
+	}
+	if dest := c.RemoteAddr(); reset && dest != nil {
+		c.edp.resetPeer(c.edp.shardOf(c.connID.lid), dest, c.connID)
+	}
+	if c.forceShutdown() { // only in _S_EST1
+		c.outlock.Unlock()
+		c.stopLoops()
+		return
+	}
+	if atomic.LoadInt32(&c.state) == _S_FIN {
+		c.outlock.Unlock()
+		return
+	}
+	// closing is in progress, the waits for the peer give up
+	atomic.StoreInt32(&c.aborted, 1)
+	c.closeEvRead()
+	select {
+	case c.evSend <- _CLOSE:
+	default:
+	}
+	c.outlock.Unlock()
+	// nobody is closing, then finish it here
+	if atomic.LoadInt32(&c.halfW) != 0 && atomic.LoadInt32(&c.state) == _S_FIN0 {
+		c.closeR(nil)
+	} else if c.isPeerHalfClosed() && atomic.CompareAndSwapInt32(&c.wClosed, 0, 1) {
+		c.afterCloseW()
+		atomic.StoreInt32(&c.state, _S_FIN)
+		c.evAck <- _CLOSE
+		c.afterShutdown()
+	}
+}
+
+// the error to reply after connection closed
+func (c *Conn) closeErr() error {
+	if e, _ := c.err.Load().(connErr); e.error != nil {
+		return e.error
+	}
+	return io.EOF
+}
@@ -1,5 +1,25 @@
 package suft
 
+// Serial number arithmetic (RFC 1982)
+//
+// The seq wraps around 2^32, so they are never compared as integers,
+// the one within 2^31 after another is the later one.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+func seqMax(a, b uint32) uint32 {
+	if seqAfter(b, a) {
+		return b
+	} else {
+		return a
+	}
+}
+
 type qNode struct {
 	*packet
 	prev   *qNode
@@ -153,7 +173,7 @@ func (l *linkedMap) insertAfter(ref, one *qNode) {
 // if inserted, return the distance between newNode with baseHead
 func (l *linkedMap) searchInsert(one *qNode, baseHead uint32) (dis int64) {
 	for i := l.tail; i != nil; i = i.prev {
-		dis = int64(one.seq) - int64(i.seq)
+		dis = int64(seqDiff(one.seq, i.seq))
 		if dis > 0 {
 			l.insertAfter(i, one)
 			return
@@ -162,7 +182,7 @@ func (l *linkedMap) searchInsert(one *qNode, baseHead uint32) (dis int64) {
 			return
 		}
 	}
-	if one.seq <= baseHead {
+	if !seqAfter(one.seq, baseHead) {
 		return 0
 	}
 	if l.head != nil {
@@ -172,7 +192,7 @@ func (l *linkedMap) searchInsert(one *qNode, baseHead uint32) (dis int64) {
 		l.tail = one
 		l.qmap[one.seq] = one
 	}
-	dis = int64(one.seq) - int64(baseHead)
+	dis = int64(seqDiff(one.seq, baseHead))
 	return
 }
 
@@ -232,7 +252,7 @@ func (l *linkedMap) makeHolesBitmap(prev uint32) ([]uint64, uint32) {
 	var bits uint64
 	var j uint32
 	for i := l.head; i != nil; i = i.next {
-		if i.seq >= prev+1 {
+		if seqAfter(i.seq, prev) {
 			start = i
 			break
 		}
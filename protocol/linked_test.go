@@ -234,3 +234,55 @@ func Benchmark_apply_bitmap(b *testing.B) {
 		lmap.deleteByBitmap(ackbitmap, 1, 64)
 	}
 }
+
+func Test_seq_serial(t *testing.T) {
+	assert(seqAfter(1, 0) && seqAfter(0, 0xffffffff) && seqAfter(5, 0xfffffff0), t, "after")
+	assert(!seqAfter(0xfffffff0, 5) && !seqAfter(7, 7), t, "not after")
+	assert(seqDiff(3, 0xfffffffe) == 5 && seqDiff(0xfffffffe, 3) == -5, t, "diff")
+	assert(seqMax(0xffffffff, 2) == 2 && seqMax(2, 0xffffffff) == 2, t, "max")
+}
+
+func Test_bitmap_wrap(t *testing.T) {
+	var prev uint32 = 0xffffffff - 100
+	var head = prev + 1
+
+	lmap.reset()
+	var holes = make([]uint32, 0, 100)
+	for i := head; i != 200; i++ {
+		if i%3 == 0 {
+			holes = append(holes, i)
+			continue
+		}
+		lmap.appendTail(node(int(i)))
+	}
+	bmap, tbl := lmap.makeHolesBitmap(prev)
+	testBitmap(t, bmap, prev)
+
+	lmap.reset()
+	for i := head; i != 200; i++ {
+		lmap.appendTail(node(int(i)))
+	}
+	lmap.deleteByBitmap(bmap, head, tbl)
+	var holesResult = make([]uint32, 0, 100)
+	for i := lmap.head; i != nil; i = i.next {
+		if i.scnt != _SENT_OK {
+			holesResult = append(holesResult, i.seq)
+		}
+	}
+	a := fmt.Sprintf("%x", holes)
+	b := fmt.Sprintf("%x", holesResult)
+	assert(a == b, t, "deleteByBitmap \na=%s \nb=%s", a, b)
+
+	// unordered insert across the wrap
+	lmap.reset()
+	for _, i := range rand.Perm(200) {
+		lmap.searchInsert(node(int(head+uint32(i))), prev)
+	}
+	assert(lmap.searchInsert(node(int(prev)), prev) == 0, t, "inserted the old one")
+	seq := head
+	for i := lmap.head; i != nil; i = i.next {
+		assert(i.seq == seq, t, "seq=%x want %x", i.seq, seq)
+		seq++
+	}
+	assert(seq == head+200, t, "size %d", seq-head)
+}
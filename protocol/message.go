@@ -0,0 +1,98 @@
+package suft
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Message mode
+//
+// A message is written in its own DATA packets, the last one is marked
+// by EOR, so the boundaries are kept by the reliable stream and one
+// WriteMsg is read by exactly one ReadMsg of the peer. The reader records
+// the end of every message moved into inQReady, the ends passed by Read
+// are dropped, then the stream could be mixed with messages. EOR reuses
+// the SYN bit of DATA, so it's only used if _FEAT_MSG was negotiated.
+//
+// A message is buffered completely before it's read, so it couldn't be
+// larger than the receive buffer of peer, otherwise the window never opens.
+
+var ErrMsgTooLarge = errors.New("Message too large")
+
+// the largest message the peer could buffer. The peer counts the packets
+// by maxMss but they are split by the current mss, and keeps one packet
+// spare for the partial one counted by the window.
+func (c *Conn) maxMsgSize() int {
+	pkts := c.peerRbuf/c.maxMss - 1
+	return maxI(pkts, 0) * int(atomic.LoadInt32(&c.mss))
+}
+
+// WriteMsg sends msg as one message, which will be returned by one ReadMsg
+// of the peer. The connection should be closed if an error was returned,
+// because the message may be sent partially.
+// should not call this function concurrently with Write.
+func (c *Conn) WriteMsg(msg []byte) error {
+	if c.features&_FEAT_MSG == 0 {
+		return ErrIncompatible
+	}
+	if len(msg) > c.maxMsgSize() {
+		return ErrMsgTooLarge
+	}
+	_, err := c.write(msg, true)
+	return err
+}
+
+// ReadMsg returns the next message written by WriteMsg of the peer,
+// io.ErrUnexpectedEOF if the connection was closed in the middle of one.
+// should not call this function concurrently with Read.
+func (c *Conn) ReadMsg() ([]byte, error) {
+	var closed bool
+	for {
+		c.readInQ()
+		c.inlock.Lock()
+		msg, opened := c.nextMsg()
+		partial := len(c.inQReady) > 0
+		c.inlock.Unlock()
+		if opened {
+			c.notifyWindow()
+		}
+		if msg != nil {
+			return msg, nil
+		}
+		if closed {
+			if partial {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, c.closeErr()
+		}
+		y, err := c.waitRead()
+		if err != nil {
+			return nil, err
+		}
+		closed = !y
+	}
+}
+
+// called by Read in inlock, drop the ends passed, including the one
+// reached exactly, so they never pile up without ReadMsg.
+func (c *Conn) skipMsgEnds() {
+	var i int
+	for i < len(c.msgEnds) && c.msgEnds[i] <= c.readPos {
+		i++
+	}
+	c.msgEnds = c.msgEnds[i:]
+}
+
+// take the message completed in inQReady, must in inlock.
+// return nil if there isn't any.
+func (c *Conn) nextMsg() (msg []byte, opened bool) {
+	if len(c.msgEnds) == 0 {
+		return nil, false
+	}
+	n := int(c.msgEnds[0] - c.readPos)
+	c.msgEnds = c.msgEnds[1:]
+	msg = make([]byte, n)
+	copy(msg, c.inQReady)
+	return msg, c.consumeReady(n)
+}
@@ -0,0 +1,171 @@
+package suft
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+)
+
+// Connection migration
+//
+// Each side sends a random token in the SYN (or SYN+ACK) payload, which
+// is never sent again. When a packet with a valid connection ID comes
+// from an address other than the dest, the receiver challenges the new
+// address with a nonce, and the peer must answer with the HMAC of the
+// nonce keyed by its token. Then the dest and the registry are switched.
+//
+// CTRL packet payload:
+//
+//	challenge: TYPE:1 | NONCE:8
+//	response:  TYPE:1 | NONCE:8 | MAC:8
+const (
+	_TOKEN_SIZE = 8
+	_NONCE_SIZE = 8
+	_MAC_SIZE   = 8
+)
+
+type pathState struct {
+	lock      sync.Mutex
+	token     uint64 // mine
+	peerToken uint64 // zero means the peer doesn't support migration
+	probe     net.Addr
+	nonce     uint64
+	sent      int64
+}
+
+func randU64() uint64 {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if v := binary.BigEndian.Uint64(b[:]); v != 0 {
+			return v
+		}
+	}
+}
+
+// called while handshaking with the payload of SYN or SYN+ACK
+func (c *Conn) setPeerToken(payload []byte) {
+	if len(payload) >= _TOKEN_SIZE {
+		c.path.lock.Lock()
+		c.path.peerToken = binary.BigEndian.Uint64(payload)
+		c.path.lock.Unlock()
+	}
+}
+
+func pathMAC(token, nonce uint64) []byte {
+	var key, msg [8]byte
+	binary.BigEndian.PutUint64(key[:], token)
+	binary.BigEndian.PutUint64(msg[:], nonce)
+	m := hmac.New(sha256.New, key[:])
+	m.Write(msg[:])
+	return m.Sum(nil)[:_MAC_SIZE]
+}
+
+func isPathCtrl(buf []byte) bool {
+	return buf[_TH_SIZE+8] == _F_CTRL && len(buf) > _AH_SIZE &&
+		(buf[_AH_SIZE] == _C_PATH_CHALLENGE || buf[_AH_SIZE] == _C_PATH_RESPONSE)
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if x, y := a.(*net.UDPAddr); y {
+		if z, y := b.(*net.UDPAddr); y {
+			return x.Port == z.Port && x.Zone == z.Zone && x.IP.Equal(z.IP)
+		}
+		return false
+	}
+	return a != nil && b != nil && a.Network() == b.Network() && a.String() == b.String()
+}
+
+// send ctrl packet to the addr instead of dest
+func (c *Conn) writeCtrlTo(payload []byte, addr net.Addr) {
+	pk := &packet{flag: _F_CTRL, payload: payload}
+	buf := nodeOf(pk).marshall(c.connID)
+	c.sock.WriteTo(buf, addr)
+}
+
+// a packet of this connection came from the addr which isn't the dest,
+// then challenge the addr at most once per rto.
+func (c *Conn) validatePath(addr net.Addr) {
+	p := &c.path
+	p.lock.Lock()
+	if p.peerToken == 0 ||
+		(p.probe != nil && sameAddr(p.probe, addr) && Now()-p.sent < maxI64(c.rto, _MIN_RTO)) {
+		p.lock.Unlock()
+		return
+	}
+	p.probe = addr
+	p.nonce = randU64()
+	p.sent = Now()
+	payload := make([]byte, 1+_NONCE_SIZE)
+	payload[0] = _C_PATH_CHALLENGE
+	binary.BigEndian.PutUint64(payload[1:], p.nonce)
+	p.lock.Unlock()
+	c.writeCtrlTo(payload, addr)
+	if debug >= 1 {
+		log.Println("challenge path", addr)
+	}
+}
+
+func (c *Conn) processPath(addr net.Addr, buf []byte) {
+	body := buf[_AH_SIZE:]
+	switch body[0] {
+	case _C_PATH_CHALLENGE:
+		if len(body) < 1+_NONCE_SIZE {
+			return
+		}
+		nonce := binary.BigEndian.Uint64(body[1:])
+		payload := make([]byte, 1+_NONCE_SIZE+_MAC_SIZE)
+		payload[0] = _C_PATH_RESPONSE
+		copy(payload[1:], body[1:1+_NONCE_SIZE])
+		c.path.lock.Lock()
+		copy(payload[1+_NONCE_SIZE:], pathMAC(c.path.token, nonce))
+		c.path.lock.Unlock()
+		// answer on the path where the challenge came from
+		c.writeCtrlTo(payload, addr)
+
+	case _C_PATH_RESPONSE:
+		if len(body) < 1+_NONCE_SIZE+_MAC_SIZE {
+			return
+		}
+		p := &c.path
+		nonce := binary.BigEndian.Uint64(body[1:])
+		p.lock.Lock()
+		valid := p.probe != nil && sameAddr(p.probe, addr) && p.nonce == nonce &&
+			hmac.Equal(body[1+_NONCE_SIZE:1+_NONCE_SIZE+_MAC_SIZE], pathMAC(p.peerToken, nonce))
+		if valid {
+			p.probe = nil
+		}
+		p.lock.Unlock()
+		if valid {
+			c.migrate(addr)
+		}
+	}
+}
+
+// the boxed dest, atomic.Value can't store nil or different types
+type destAddr struct{ net.Addr }
+
+func (c *Conn) setDest(addr net.Addr) {
+	c.dest.Store(destAddr{addr})
+}
+
+// switch the dest to the validated addr
+func (c *Conn) migrate(addr net.Addr) {
+	c.outlock.Lock()
+	c.inlock.Lock()
+	old := c.RemoteAddr()
+	c.setDest(addr)
+	c.inlock.Unlock()
+	c.outlock.Unlock()
+	if old != nil {
+		c.edp.moveConn(c.connID, old, addr)
+	}
+	c.resetPmtu()
+	log.Println("migrated from", old, "to", addr)
+}
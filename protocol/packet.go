@@ -6,17 +6,26 @@ import (
 )
 
 const (
-	_F_NIL  = 0
-	_F_SYN  = 1
-	_F_ACK  = 1 << 1
-	_F_SACK = 1 << 2
-	_F_TIME = 1 << 3
-	_F_DATA = 1 << 4
-	// reserved  = 1 << 5
+	_F_NIL   = 0
+	_F_SYN   = 1 // aliased by _F_EOR in DATA
+	_F_ACK   = 1 << 1
+	_F_SACK  = 1 << 2
+	_F_TIME  = 1 << 3
+	_F_DATA  = 1 << 4
+	_F_CTRL  = 1 << 5
 	_F_RESET = 1 << 6
 	_F_FIN   = 1 << 7
 )
 
+// The last DATA packet of a message if _FEAT_MSG was negotiated.
+// All 8 bits of flag are taken, so it's the bit of _F_SYN: SYN never
+// goes with DATA, then the bit means EOR only if _F_DATA is set too.
+// It's never sent to the peer without _FEAT_MSG, see WriteMsg.
+const _F_EOR = _F_SYN
+
+// a fragment of the oversized DATA packet
+const _F_FRAG = _F_CTRL
+
 var packetTypeNames = map[byte]string{
 	0:   "NOOP",
 	1:   "SYN",
@@ -26,11 +35,26 @@ var packetTypeNames = map[byte]string{
 	8:   "TIME",
 	12:  "SACK+TIME",
 	16:  "DATA",
+	17:  "DATA+EOR",
+	48:  "DATA+FRAG",
+	49:  "DATA+FRAG+EOR",
+	32:  "CTRL",
 	64:  "RESET",
 	128: "FIN",
 	192: "FIN+RESET",
 }
 
+// types of control packet, the first byte of CTRL payload
+const (
+	_C_PATH_CHALLENGE = iota + 1
+	_C_PATH_RESPONSE
+	_C_COOKIE
+	_C_PMTU_PROBE
+	_C_PMTU_ACK
+	_C_DATAGRAM
+	_C_DATAGRAM_ACK
+)
+
 const (
 	_S_FIN = iota
 	_S_FIN0
@@ -41,12 +65,25 @@ const (
 	_S_EST1
 )
 
+var stateNames = map[int32]string{
+	_S_FIN:  "CLOSED",
+	_S_FIN0: "FIN_W",
+	_S_FIN1: "FIN_R",
+	_S_SYN0: "SYN_SENT",
+	_S_SYN1: "SYN_RECV",
+	_S_EST0: "ESTABLISHING",
+	_S_EST1: "ESTABLISHED",
+}
+
 // Magic-6 | TH-10 | CH-10 | payload
 const (
+	_MAGIC      = "\xa5SUFT\x00"
 	_MAGIC_SIZE = 6
 	_TH_SIZE    = 10 + _MAGIC_SIZE
 	_CH_SIZE    = 10
 	_AH_SIZE    = _TH_SIZE + _CH_SIZE
+	// SACK payload: TBL:1 | SCNT:1 | DELAY:4 | bitmap
+	_SACK_HEAD = 6
 )
 
 const (
@@ -75,6 +112,7 @@ func (p *packet) marshall(id connID) []byte {
 		buf = make([]byte, _AH_SIZE+len(p.payload))
 		copy(buf[_TH_SIZE+10:], p.payload)
 	}
+	copy(buf, _MAGIC)
 	binary.BigEndian.PutUint16(buf[_MAGIC_SIZE:], uint16(len(buf)))
 	binary.BigEndian.PutUint32(buf[_MAGIC_SIZE+2:], id.rid)
 	binary.BigEndian.PutUint32(buf[_MAGIC_SIZE+6:], id.lid)
@@ -109,7 +147,15 @@ func maxI64(a, b int64) int64 {
 	}
 }
 
-func maxU32(a, b uint32) uint32 {
+func minI64(a, b int64) int64 {
+	if a <= b {
+		return a
+	} else {
+		return b
+	}
+}
+
+func maxI32(a, b int32) int32 {
 	if a >= b {
 		return a
 	} else {
@@ -117,7 +163,7 @@ func maxU32(a, b uint32) uint32 {
 	}
 }
 
-func minI64(a, b int64) int64 {
+func minI32(a, b int32) int32 {
 	if a <= b {
 		return a
 	} else {
@@ -125,16 +171,16 @@ func minI64(a, b int64) int64 {
 	}
 }
 
-func maxI32(a, b int32) int32 {
-	if a >= b {
+func minI(a, b int) int {
+	if a <= b {
 		return a
 	} else {
 		return b
 	}
 }
 
-func minI32(a, b int32) int32 {
-	if a <= b {
+func maxI(a, b int) int {
+	if a >= b {
 		return a
 	} else {
 		return b
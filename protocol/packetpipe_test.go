@@ -0,0 +1,841 @@
+package suft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type pipePacket struct {
+	data []byte
+	from net.Addr
+}
+
+// packetPipe is an in-memory net.PacketConn, any addr written to goes to the peer.
+type packetPipe struct {
+	addr     *net.UDPAddr
+	peer     *packetPipe
+	in       chan pipePacket
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	deadline time.Time
+	// drop returns true if the outgoing packet should be lost, guarded by mu
+	drop func(b []byte) bool
+}
+
+func newPacketPipe() (a, b *packetPipe) {
+	a = &packetPipe{
+		addr:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001},
+		in:     make(chan pipePacket, 1024),
+		closed: make(chan struct{}),
+	}
+	b = &packetPipe{
+		addr:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002},
+		in:     make(chan pipePacket, 1024),
+		closed: make(chan struct{}),
+	}
+	a.peer, b.peer = b, a
+	return
+}
+
+func (p *packetPipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	deadline := p.deadline
+	p.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pk := <-p.in:
+		return copy(b, pk.data), pk.from, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, ErrIOTimeout
+	}
+}
+
+func (p *packetPipe) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if addr == nil {
+		return 0, errors.New("nil addr")
+	}
+	p.mu.Lock()
+	drop := p.drop
+	p.mu.Unlock()
+	// the peer is not there any more
+	if !sameAddr(addr, p.peer.LocalAddr()) || (drop != nil && drop(b)) {
+		return len(b), nil
+	}
+	pk := pipePacket{data: append([]byte(nil), b...), from: p.LocalAddr()}
+	select {
+	case p.peer.in <- pk:
+	default: // dropped like UDP does
+	}
+	return len(b), nil
+}
+
+func (p *packetPipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *packetPipe) LocalAddr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr
+}
+
+// rebind to another port, like NAT rebinding
+func (p *packetPipe) rebind(port int) {
+	p.mu.Lock()
+	p.addr = &net.UDPAddr{IP: p.addr.IP, Port: port}
+	p.mu.Unlock()
+}
+
+// setDrop changes the loss of outgoing packets while the endpoint is running
+func (p *packetPipe) setDrop(drop func(b []byte) bool) {
+	p.mu.Lock()
+	p.drop = drop
+	p.mu.Unlock()
+}
+
+func (p *packetPipe) SetDeadline(t time.Time) error { return p.SetReadDeadline(t) }
+
+func (p *packetPipe) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.deadline = t
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *packetPipe) SetWriteDeadline(t time.Time) error { return nil }
+
+func Test_endpoint_over_packet_pipe(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var data = make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		conn, err := cli.Dial(a.addr.String())
+		if err == nil {
+			conn.Write(data)
+			conn.Close()
+		}
+	}()
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	recv, err := io.ReadAll(conn)
+	assert(err == nil, t, "read %v", err)
+	assert(bytes.Equal(recv, data), t, "recv %d bytes", len(recv))
+	conn.Close()
+}
+
+// drop the first n packets matching the flag
+func dropFirst(n int, flag byte) func([]byte) bool {
+	var mu sync.Mutex
+	return func(b []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if n > 0 && b[_TH_SIZE+8] == flag {
+			n--
+			return true
+		}
+		return false
+	}
+}
+
+func Test_simultaneous_open(t *testing.T) {
+	a, b := newPacketPipe()
+	// lose the first syn of both sides, then both dialings are pending
+	a.setDrop(dropFirst(1, _F_SYN))
+	b.setDrop(dropFirst(1, _F_SYN))
+	ea, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, Symmetric: true})
+	assert(err == nil, t, "ea %v", err)
+	defer ea.Close()
+	eb, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10, Symmetric: true})
+	assert(err == nil, t, "eb %v", err)
+	defer eb.Close()
+
+	var wg sync.WaitGroup
+	var ca, cb *Conn
+	var errA, errB error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ca, errA = ea.Dial(b.addr.String())
+	}()
+	go func() {
+		defer wg.Done()
+		cb, errB = eb.Dial(a.addr.String())
+	}()
+	wg.Wait()
+	assert(errA == nil && errB == nil, t, "dial a=%v b=%v", errA, errB)
+	// both dialings are merged into one connection
+	assert(ca.connID.lid == cb.connID.rid && ca.connID.rid == cb.connID.lid, t, "a=%v b=%v", ca.connID, cb.connID)
+	conn, err := ea.AcceptContext(ctxTimeout(t, 100*time.Millisecond))
+	assert(conn == nil && err != nil, t, "unexpected accepted %v", conn)
+
+	go func() {
+		ca.Write([]byte("ping"))
+		ca.Close()
+	}()
+	recv, err := io.ReadAll(cb)
+	assert(err == nil && string(recv) == "ping", t, "recv %q %v", recv, err)
+	cb.Close()
+}
+
+func Test_connection_migration(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var data = make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		conn, err := cli.Dial(a.addr.String())
+		if err == nil {
+			conn.Write(data[:len(data)/2])
+			// the address of client was changed in the middle of stream
+			b.rebind(20002)
+			conn.Write(data[len(data)/2:])
+			conn.Close()
+		}
+	}()
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	recv, err := io.ReadAll(conn)
+	assert(err == nil, t, "read %v", err)
+	assert(bytes.Equal(recv, data), t, "recv %d bytes", len(recv))
+	assert(sameAddr(conn.RemoteAddr(), b.LocalAddr()), t, "remote %s", conn.RemoteAddr())
+	conn.Close()
+}
+
+func Test_migration_forged_response(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	go cli.Dial(a.addr.String())
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	orig := conn.RemoteAddr()
+	evil := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 666}
+	conn.validatePath(evil)
+	// the attacker knows the connection ID and the nonce but the token
+	var payload = make([]byte, 1+_NONCE_SIZE+_MAC_SIZE)
+	payload[0] = _C_PATH_RESPONSE
+	binary.BigEndian.PutUint64(payload[1:], conn.path.nonce)
+	buf := nodeOf(&packet{flag: _F_CTRL, payload: payload}).marshall(conn.connID)
+	conn.processPath(evil, buf)
+	assert(sameAddr(conn.RemoteAddr(), orig), t, "migrated to %s", conn.RemoteAddr())
+}
+
+func Test_keepalive(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	go cli.Dial(a.addr.String())
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	conn.SetKeepAlivePeriod(30 * time.Millisecond)
+	conn.SetIdleTimeout(100 * time.Millisecond)
+	// the peer answers probes
+	time.Sleep(300 * time.Millisecond)
+	assert(!conn.IsClosed(), t, "closed while peer is alive")
+
+	// the peer vanished
+	b.setDrop(func([]byte) bool { return true })
+	t0 := time.Now()
+	n, err := conn.Read(make([]byte, 10))
+	assert(n == 0 && err == ErrIOTimeout, t, "read %d %v", n, err)
+	assert(time.Since(t0) < time.Second, t, "detected after %s", time.Since(t0))
+	serv.mlock.RLock()
+	assert(len(serv.lRegistry) == 0, t, "leaked conn")
+	serv.mlock.RUnlock()
+}
+
+func Test_keepalive_closing(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	go cli.Dial(a.addr.String())
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	conn.SetIdleTimeout(100 * time.Millisecond)
+	// the peer vanished while closing
+	b.setDrop(func([]byte) bool { return true })
+	go conn.CloseWrite()
+	t0 := time.Now()
+	n, err := conn.Read(make([]byte, 10))
+	assert(n == 0 && err == ErrIOTimeout, t, "read %d %v", n, err)
+	assert(time.Since(t0) < time.Second, t, "detected after %s", time.Since(t0))
+	for i := 0; ; i++ {
+		serv.mlock.RLock()
+		n := len(serv.lRegistry)
+		serv.mlock.RUnlock()
+		if n == 0 {
+			break
+		}
+		assert(i < 100, t, "leaked conn")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(conn.Close() == nil, t, "close")
+}
+
+func Test_half_close(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var reply = make(chan []byte, 1)
+	go func() {
+		conn, err := cli.Dial(a.addr.String())
+		if err != nil {
+			reply <- nil
+			return
+		}
+		conn.Write([]byte("request"))
+		conn.CloseWrite()
+		// still readable after CloseWrite
+		data, _ := io.ReadAll(conn)
+		reply <- data
+		conn.Close()
+	}()
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	req, err := io.ReadAll(conn)
+	assert(err == nil && string(req) == "request", t, "req %q %v", req, err)
+	// peer closed W only, we are still writable
+	_, err = conn.Write([]byte("response"))
+	assert(err == nil, t, "write %v", err)
+	assert(conn.CloseWrite() == nil, t, "close write")
+	assert(string(<-reply) == "response", t, "reply")
+
+	assert(selfSpinWait(func() bool {
+		serv.mlock.RLock()
+		defer serv.mlock.RUnlock()
+		return len(serv.lRegistry) == 0
+	}) == nil, t, "serv conn leaked")
+	assert(selfSpinWait(func() bool {
+		cli.mlock.RLock()
+		defer cli.mlock.RUnlock()
+		return len(cli.lRegistry) == 0
+	}) == nil, t, "cli conn leaked")
+}
+
+func Test_close_after_half(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	conn.Write([]byte("request"))
+	assert(conn.CloseWrite() == nil, t, "close write")
+	// the peer never closes, Close resets it instead of waiting
+	t0 := time.Now()
+	assert(conn.Close() == nil, t, "close")
+	assert(time.Since(t0) < 500*time.Millisecond, t, "closed after %s", time.Since(t0))
+	req, err := io.ReadAll(sc)
+	assert(string(req) == "request", t, "req %q %v", req, err)
+	assert(selfSpinWait(func() bool {
+		_, err := sc.Write([]byte("response"))
+		return err != nil
+	}) == nil, t, "write to the reset conn")
+	assert(selfSpinWait(func() bool {
+		cli.mlock.RLock()
+		defer cli.mlock.RUnlock()
+		return len(cli.lRegistry) == 0
+	}) == nil, t, "cli conn leaked")
+}
+
+func Test_close_read(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var done = make(chan error, 1)
+	go func() {
+		conn, err := cli.Dial(a.addr.String())
+		if err == nil {
+			_, err = conn.Write(make([]byte, 256<<10))
+		}
+		done <- err
+	}()
+	conn, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	assert(conn.CloseRead() == nil, t, "close read")
+	n, err := conn.Read(make([]byte, 10))
+	assert(n == 0 && err == io.EOF, t, "read %d %v", n, err)
+	// writer isn't blocked by the discarded data
+	assert(<-done == nil, t, "write")
+}
+
+// wait until the search of path MTU completed
+func waitPmtu(t *testing.T, c *Conn) int {
+	for i := 0; ; i++ {
+		p := &c.pmtu
+		p.lock.Lock()
+		lo, hi := p.lo, p.hi
+		done := p.size == 0 && hi-lo < _PMTU_STEP
+		p.lock.Unlock()
+		if done {
+			return int(atomic.LoadInt32(&c.mss))
+		}
+		assert(i < 300, t, "pmtu searching lo=%d hi=%d", lo, hi)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_pmtu_black_hole(t *testing.T) {
+	const limit = 1300 // udp payload
+	a, b := newPacketPipe()
+	drop := func(b []byte) bool { return len(b) > limit }
+	a.setDrop(drop)
+	b.setDrop(drop)
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	assert(conn.maxMss == _MSS && atomic.LoadInt32(&conn.mss) == _BASE_MSS, t, "mss %d/%d", conn.mss, conn.maxMss)
+	mss := waitPmtu(t, conn)
+	assert(mss <= limit-_AH_SIZE && mss > limit-_AH_SIZE-_PMTU_STEP, t, "mss %d", mss)
+
+	// nothing is black-holed
+	var data = make([]byte, 100<<10)
+	go func() {
+		conn.Write(data)
+		conn.Close()
+	}()
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	recv, err := io.ReadAll(sc)
+	assert(err == nil && len(recv) == len(data), t, "recv %d bytes %v", len(recv), err)
+	sc.Close()
+}
+
+func Test_migration_smaller_mtu(t *testing.T) {
+	const limit = 1300 // udp payload of the new path
+	var small int32
+	a, b := newPacketPipe()
+	a.setDrop(func(b []byte) bool { return atomic.LoadInt32(&small) != 0 && len(b) > limit })
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	assert(waitPmtu(t, sc) == _MSS, t, "mss %d", sc.mss)
+
+	var data = make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		sc.Write(data)
+		sc.Close()
+	}()
+	recv := make([]byte, 256<<10)
+	_, err = io.ReadFull(conn, recv)
+	assert(err == nil, t, "read %v", err)
+	// the packets in flight are larger than the new path
+	b.rebind(20002)
+	atomic.StoreInt32(&small, 1)
+	done := make(chan []byte)
+	go func() {
+		rest, _ := io.ReadAll(conn)
+		done <- append(recv, rest...)
+	}()
+	select {
+	case recv = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("stalled after migration")
+	}
+	assert(bytes.Equal(recv, data), t, "recv %d bytes", len(recv))
+	assert(sameAddr(sc.RemoteAddr(), b.LocalAddr()), t, "remote %s", sc.RemoteAddr())
+	conn.Close()
+}
+
+func Test_seq_wrap(t *testing.T) {
+	defer func(f func() uint32) { initialSeq = f }(initialSeq)
+	initialSeq = func() uint32 { return 0xffffffff - 50 }
+	a, b := newPacketPipe()
+	// lose some, then the retransmission and sack cross the wrap
+	a.setDrop(dropFirst(3, _F_DATA))
+	b.setDrop(dropFirst(3, _F_DATA))
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var data = make([]byte, 300<<10)
+	rand.Read(data)
+	go func() {
+		conn, err := cli.Dial(a.addr.String())
+		if err == nil {
+			go conn.Write(data)
+			recv, _ := io.ReadAll(conn)
+			if bytes.Equal(recv, data) {
+				conn.Close()
+			}
+		}
+	}()
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+	sc.outlock.Lock()
+	seq := sc.mySeq
+	sc.outlock.Unlock()
+	assert(seq == 0xffffffff-50, t, "seq %x", seq)
+	go func() {
+		sc.Write(data)
+		sc.CloseWrite()
+	}()
+	recv, err := io.ReadAll(sc)
+	assert(err == nil && bytes.Equal(recv, data), t, "recv %d bytes %v", len(recv), err)
+	sc.outlock.Lock()
+	seq = sc.mySeq
+	sc.outlock.Unlock()
+	assert(seqAfter(seq, 0xffffffff) && seq < 1000, t, "not wrapped %x", seq)
+	// the FIN crossed the wrap is acked
+	assert(sc.Close() == nil, t, "close")
+}
+
+func Test_flow_control(t *testing.T) {
+	const limit = 64 << 10
+	var blackout int32
+	a, b := newPacketPipe()
+	a.setDrop(func([]byte) bool { return atomic.LoadInt32(&blackout) != 0 })
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 50, IsServ: true, RecvBuffer: limit})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 50})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	var data = make([]byte, 1<<20)
+	rand.Read(data)
+	var written int32
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	go func() {
+		conn.Write(data)
+		atomic.StoreInt32(&written, 1)
+		conn.Close()
+	}()
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+
+	// nobody reads, the sender is paused by the window
+	time.Sleep(300 * time.Millisecond)
+	assert(atomic.LoadInt32(&written) == 0, t, "sender wasn't paused")
+	sc.inlock.Lock()
+	buffered := len(sc.inQReady) + int(sc.inQ.size())*sc.maxMss
+	sc.inlock.Unlock()
+	assert(buffered <= limit+sc.maxMss, t, "buffered %d", buffered)
+
+	conn.outlock.Lock()
+	assert(!seqAfter(conn.mySeq, conn.sndEdge), t, "sent %d beyond the window", seqDiff(conn.mySeq, conn.sndEdge))
+	conn.outlock.Unlock()
+
+	// the updates of window are lost while reading, the sender will probe it
+	atomic.StoreInt32(&blackout, 1)
+	done := make(chan []byte)
+	go func() {
+		recv, _ := io.ReadAll(sc)
+		done <- recv
+	}()
+	time.Sleep(300 * time.Millisecond)
+	atomic.StoreInt32(&blackout, 0)
+
+	var recv []byte
+	select {
+	case recv = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the window was never reopened")
+	}
+	assert(bytes.Equal(recv, data), t, "recv %d bytes", len(recv))
+	sc.Close()
+}
+
+func Test_message_mode(t *testing.T) {
+	var count int32
+	a, b := newPacketPipe()
+	// lose some data packets, the retransmitted ones keep the boundaries
+	b.setDrop(func(p []byte) bool {
+		return p[_TH_SIZE+8]&_F_DATA != 0 && atomic.AddInt32(&count, 1)%7 == 0
+	})
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 50, IsServ: true, RecvBuffer: 256 << 10})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 50})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+
+	err = conn.WriteMsg(make([]byte, conn.maxMsgSize()+1))
+	assert(err == ErrMsgTooLarge, t, "too large %v", err)
+	// EOR isn't understood by the peer without _FEAT_MSG
+	err = (&Conn{features: _FEATURES &^ _FEAT_MSG}).WriteMsg(nil)
+	assert(err == ErrIncompatible, t, "not negotiated %v", err)
+
+	sizes := []int{1, 0, conn.maxMss, conn.maxMss + 1, 3*conn.maxMss + 7, 100 << 10, 5}
+	var msgs [][]byte
+	for _, n := range sizes {
+		msg := make([]byte, n)
+		rand.Read(msg)
+		msgs = append(msgs, msg)
+	}
+	go func() {
+		for i, msg := range msgs {
+			if i == 3 {
+				// the stream is mixed with messages
+				conn.Write([]byte("stream"))
+			}
+			conn.WriteMsg(msg)
+		}
+		// an incomplete message is cut by closing
+		conn.write([]byte("partial"), false)
+		conn.Close()
+	}()
+	for i, msg := range msgs {
+		if i == 3 {
+			buf := make([]byte, 6)
+			n, err := io.ReadFull(sc, buf)
+			assert(err == nil && string(buf[:n]) == "stream", t, "stream %q %v", buf[:n], err)
+		}
+		recv, err := sc.ReadMsg()
+		assert(err == nil, t, "read msg %d %v", i, err)
+		assert(bytes.Equal(recv, msg), t, "msg %d: %d bytes, expected %d", i, len(recv), len(msg))
+	}
+	_, err = sc.ReadMsg()
+	assert(err == io.ErrUnexpectedEOF, t, "partial %v", err)
+	sc.Close()
+}
+
+func Test_message_small_buffer(t *testing.T) {
+	// the window of peer is clamped to _MIN_SWND, but the message is
+	// limited by its buffer
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 50, IsServ: true, RecvBuffer: 8 << 10})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+
+	err = conn.WriteMsg(make([]byte, conn.maxMsgSize()+1))
+	assert(err == ErrMsgTooLarge, t, "too large %v", err)
+
+	msg := make([]byte, conn.maxMsgSize())
+	rand.Read(msg)
+	go conn.WriteMsg(msg)
+	done := make(chan []byte, 1)
+	go func() {
+		recv, _ := sc.ReadMsg()
+		done <- recv
+	}()
+	select {
+	case recv := <-done:
+		assert(bytes.Equal(recv, msg), t, "recv %d bytes, expected %d", len(recv), len(msg))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the message of max size was never read")
+	}
+}
+
+func Test_message_read_mixed(t *testing.T) {
+	a, b := newPacketPipe()
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 10, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 10})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+
+	conn.WriteMsg([]byte("abc"))
+	conn.WriteMsg([]byte("defg"))
+	// Read ends on the boundary, the next message isn't empty
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(sc, buf)
+	assert(err == nil && string(buf) == "abc", t, "read %q %v", buf, err)
+	msg, err := sc.ReadMsg()
+	assert(err == nil && string(msg) == "defg", t, "msg %q %v", msg, err)
+
+	// the ends don't pile up if only Read is used
+	const count = 100
+	go func() {
+		for i := 0; i < count; i++ {
+			conn.WriteMsg([]byte("message"))
+		}
+	}()
+	buf = make([]byte, count*len("message"))
+	_, err = io.ReadFull(sc, buf)
+	assert(err == nil, t, "read %v", err)
+	sc.inlock.Lock()
+	ends := len(sc.msgEnds)
+	sc.inlock.Unlock()
+	assert(ends == 0, t, "%d ends left", ends)
+}
+
+func Test_datagram(t *testing.T) {
+	var lossy int32
+	a, b := newPacketPipe()
+	b.setDrop(func(p []byte) bool {
+		return atomic.LoadInt32(&lossy) != 0 && isDgramCtrl(p)
+	})
+	serv, err := NewEndpointFromPacketConn(a, &Params{Bandwidth: 50, IsServ: true})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	cli, err := NewEndpointFromPacketConn(b, &Params{Bandwidth: 50})
+	assert(err == nil, t, "cli %v", err)
+	defer cli.Close()
+
+	conn, err := cli.Dial(a.addr.String())
+	assert(err == nil, t, "dial %v", err)
+	sc, err := serv.AcceptContext(ctxTimeout(t, 5*time.Second))
+	assert(err == nil, t, "accept %v", err)
+
+	err = conn.SendDatagram(make([]byte, conn.mss))
+	assert(err == ErrMsgTooLarge, t, "too large %v", err)
+
+	// the datagrams go alongside the stream
+	var data = make([]byte, 256<<10)
+	rand.Read(data)
+	go conn.Write(data)
+	// not more than the queue, the slow reader doesn't lose any
+	const count = _DGRAM_QUEUE
+	send := func(b []byte) (err error) {
+		for err = conn.SendDatagram(b); err == ErrCongested; err = conn.SendDatagram(b) {
+			time.Sleep(time.Millisecond)
+		}
+		return
+	}
+	go func() {
+		for i := 0; i < count; i++ {
+			send([]byte{byte(i)})
+		}
+	}()
+	seen := make(map[byte]bool)
+	for len(seen) < count {
+		b, err := sc.ReceiveDatagram(ctxTimeout(t, 5*time.Second))
+		assert(err == nil && len(b) == 1, t, "datagram %v %v", b, err)
+		seen[b[0]] = true
+	}
+	recv := make([]byte, len(data))
+	_, err = io.ReadFull(sc, recv)
+	assert(err == nil && bytes.Equal(recv, data), t, "stream %v", err)
+
+	// the lost datagrams are never resent, but release the cwnd
+	atomic.StoreInt32(&lossy, 1)
+	for i := 0; i < 5; i++ {
+		assert(send([]byte("lost")) == nil, t, "send lost")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = sc.ReceiveDatagram(ctx)
+	assert(err == context.DeadlineExceeded, t, "received lost %v", err)
+	conn.outlock.Lock()
+	inflight, pending := len(conn.dgram.sent), conn.outPending
+	conn.outlock.Unlock()
+	assert(inflight == 0 && pending == 0, t, "inflight %d pending %d", inflight, pending)
+
+	conn.Close()
+	_, err = sc.ReceiveDatagram(ctxTimeout(t, 5*time.Second))
+	assert(err == io.EOF, t, "closed %v", err)
+	sc.Close()
+}
+
+func Test_datagram_ack(t *testing.T) {
+	c := &Conn{evSend: make(chan byte, 1), cwnd: 8, missed: 3, outPending: 2}
+	c.dgram.init()
+	c.dgram.sent[1] = Now()
+	// the ack releases the datagram only, the state of stream is kept
+	ack := nodeOf(&packet{flag: _F_CTRL, payload: []byte{_C_DATAGRAM_ACK, 0, 0, 0, 1}}).marshall(connID{})
+	assert(isDgramCtrl(ack), t, "ack %x", ack)
+	c.processDatagram(nil, ack)
+	assert(len(c.dgram.sent) == 0, t, "inflight %d", len(c.dgram.sent))
+	assert(c.missed == 3 && c.outPending == 2 && c.cwnd == 8, t, "missed %d pending %d cwnd %d", c.missed, c.outPending, c.cwnd)
+	assert(len(c.evSend) == 1, t, "sender not notified")
+}
@@ -0,0 +1,195 @@
+package suft
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Path MTU discovery, like DPLPMTUD of RFC 8899
+//
+// The MSS agreed in handshake is the largest payload both sides could
+// receive, which is limited by Params.Mtu. The connection starts with the
+// base size working on almost all paths, then probes the larger sizes by
+// the padded CTRL packets. The probes are answered by the peer but never
+// retransmitted, and their loss isn't taken as congestion. The size is
+// confirmed if one of _PROBE_TRIES probes was answered, the largest one
+// is searched by bisection, then searched again after _PMTU_RAISE or
+// from the base if the connection was migrated to another path.
+// Only the packets sent later take the larger MSS, and the ones built
+// larger than the new path are re-split into fragments (frag.go).
+//
+// The socket sets DF and ignores the PMTU of kernel (linux), so the
+// probes are never fragmented.
+//
+//	probe: TYPE:1 | ID:4 | padding
+//	ack:   TYPE:1 | ID:4
+const (
+	_MIN_MTU    = 576
+	_MAX_MTU    = 65535
+	_UDP4_HDR   = 28
+	_UDP6_HDR   = 48
+	_MAX_PACKET = 1600 // receiving buffer if Params.Mtu isn't larger
+	// base PLPMTU of RFC 8899 is 1200 bytes of udp payload
+	_BASE_MSS      = 1200 - _AH_SIZE
+	_PROBE_TRIES   = 3
+	_PROBE_MIN_TMO = 50 * _MS
+	_PMTU_STEP     = 16
+	_PMTU_RAISE    = 600e6 // us
+)
+
+type pmtuState struct {
+	lock    sync.Mutex
+	enabled bool
+	lo      int // confirmed
+	hi      int // the upper bound could be tried
+	bisect  bool
+	size    int // probing, 0 if none
+	id      uint32
+	tries   int
+	sent    int64
+	raise   int64 // search again after completed
+}
+
+// the largest payload of the link to addr
+func (e *Endpoint) maxMss(addr net.Addr) int {
+	ua, y := addr.(*net.UDPAddr)
+	v6 := y && ua.IP.To4() == nil
+	if e.params.Mtu == 0 {
+		if v6 {
+			// typical ipv6 header length=40
+			return _MSS - 20
+		}
+		return _MSS
+	}
+	if v6 {
+		return e.params.Mtu - _UDP6_HDR - _AH_SIZE
+	}
+	return e.params.Mtu - _UDP4_HDR - _AH_SIZE
+}
+
+// called after the MSS was agreed in handshake
+func (c *Conn) initPmtu() {
+	p := &c.pmtu
+	p.lock.Lock()
+	p.enabled = c.features&_FEAT_PMTUD != 0
+	p.lo, p.hi = c.maxMss, c.maxMss
+	if p.enabled {
+		p.lo = minI(_BASE_MSS, c.maxMss)
+	}
+	p.bisect, p.size, p.raise = false, 0, 0
+	atomic.StoreInt32(&c.mss, int32(p.lo))
+	p.lock.Unlock()
+}
+
+// the path has been changed, search from the base
+func (c *Conn) resetPmtu() {
+	if c.pmtu.enabled {
+		c.initPmtu()
+		c.notifyPmtu()
+	}
+}
+
+func (c *Conn) notifyPmtu() {
+	select {
+	case c.evPmtu <- 1:
+	default:
+	}
+}
+
+// called by internalAckLoop, return the delay of next check, 0 means no check.
+func (c *Conn) checkPmtu() int64 {
+	// rto is measured in outlock
+	c.outlock.Lock()
+	tmo := maxI64(c.rto, _PROBE_MIN_TMO)
+	c.outlock.Unlock()
+	p := &c.pmtu
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled {
+		return 0
+	}
+	now := Now()
+	if p.size > 0 {
+		if now-p.sent < tmo {
+			return tmo - (now - p.sent)
+		}
+		if p.tries >= _PROBE_TRIES { // too large
+			p.hi, p.size, p.bisect = p.size-1, 0, true
+		}
+	}
+	if p.size == 0 {
+		if p.hi-p.lo < _PMTU_STEP {
+			// completed, try the max again later
+			if p.raise == 0 {
+				p.raise = now + _PMTU_RAISE
+			}
+			if now < p.raise || c.maxMss-p.lo < _PMTU_STEP {
+				return maxI64(p.raise-now, 1)
+			}
+			p.hi, p.bisect, p.raise = c.maxMss, false, 0
+		}
+		// try the upper bound first, it works mostly
+		if p.size = p.hi; p.bisect {
+			p.size = (p.lo + p.hi + 1) >> 1
+		}
+		p.tries = 0
+		p.id++
+	}
+	p.tries++
+	p.sent = now
+	if err := c.sendPmtuProbe(p.id, p.size); err != nil {
+		// EMSGSIZE, larger than the local link
+		p.hi, p.size, p.bisect = p.size-1, 0, true
+		return 1
+	}
+	return tmo
+}
+
+func (c *Conn) sendPmtuProbe(id uint32, size int) error {
+	payload := make([]byte, size)
+	payload[0] = _C_PMTU_PROBE
+	binary.BigEndian.PutUint32(payload[1:], id)
+	pk := &packet{flag: _F_CTRL, payload: payload}
+	_, err := c.sock.WriteTo(nodeOf(pk).marshall(c.connID), c.RemoteAddr())
+	return err
+}
+
+func isPmtuCtrl(buf []byte) bool {
+	return buf[_TH_SIZE+8] == _F_CTRL && len(buf) >= _AH_SIZE+5 &&
+		(buf[_AH_SIZE] == _C_PMTU_PROBE || buf[_AH_SIZE] == _C_PMTU_ACK)
+}
+
+func (c *Conn) processPmtu(addr net.Addr, buf []byte) {
+	body := buf[_AH_SIZE:]
+	switch body[0] {
+	case _C_PMTU_PROBE:
+		// answer on the path where the probe came from
+		payload := make([]byte, 5)
+		payload[0] = _C_PMTU_ACK
+		copy(payload[1:], body[1:5])
+		c.writeCtrlTo(payload, addr)
+
+	case _C_PMTU_ACK:
+		if !sameAddr(addr, c.RemoteAddr()) {
+			return
+		}
+		p := &c.pmtu
+		p.lock.Lock()
+		confirmed := p.size > 0 && p.id == binary.BigEndian.Uint32(body[1:])
+		if confirmed {
+			p.lo, p.size = p.size, 0
+			atomic.StoreInt32(&c.mss, int32(p.lo))
+		}
+		p.lock.Unlock()
+		if confirmed {
+			if debug >= 1 {
+				log.Println("pmtu confirmed mss", p.lo, c.RemoteAddr())
+			}
+			// continue searching
+			c.notifyPmtu()
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package suft
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// set DF and ignore the PMTU of kernel, the packets larger than
+// the link will be refused by EMSGSIZE instead of fragmented.
+func setDontFragment(pc net.PacketConn) {
+	uc, y := pc.(*net.UDPConn)
+	if !y {
+		return
+	}
+	if rc, err := uc.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			// the ipv6 one fails on ipv4 socket
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package suft
+
+import (
+	"net"
+)
+
+func setDontFragment(pc net.PacketConn) {}
@@ -0,0 +1,40 @@
+package suft
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// open n sockets on the same addr, the first one may choose the port.
+func listenReusePort(network, addr string, n int) ([]net.PacketConn, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	socks := make([]net.PacketConn, 0, n)
+	for i := 0; i < n; i++ {
+		pc, err := lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			for _, s := range socks {
+				s.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			addr = pc.LocalAddr().String()
+		}
+		socks = append(socks, pc)
+	}
+	return socks, nil
+}
@@ -0,0 +1,44 @@
+package suft
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_shards(t *testing.T) {
+	const shards = 4
+	serv, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10, IsServ: true, Shards: shards})
+	assert(err == nil, t, "serv %v", err)
+	defer serv.Close()
+	assert(len(serv.socks) == shards, t, "socks %d", len(serv.socks))
+	for _, s := range serv.socks[1:] {
+		assert(s.LocalAddr().String() == serv.Addr().String(), t, "addr %v", s.LocalAddr())
+	}
+
+	// the peers from different ports are spread over the shards
+	const n = 16
+	for i := 0; i < n; i++ {
+		cli, err := NewEndpoint(&Params{LocalAddr: "127.0.0.1:0", Bandwidth: 10})
+		assert(err == nil, t, "cli %v", err)
+		defer cli.Close()
+		go func() {
+			c, err := cli.Dial(serv.Addr().String())
+			if err == nil {
+				c.Write([]byte("hi"))
+				c.Close()
+			}
+		}()
+	}
+	used := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		c, err := serv.AcceptContext(ctxTimeout(t, 3*time.Second))
+		assert(err == nil, t, "accept %d %v", i, err)
+		shard := int(c.connID.lid % shards)
+		assert(c.sock == serv.socks[shard], t, "sock of %d", c.connID.lid)
+		used[shard] = true
+		data, err := io.ReadAll(c)
+		assert(err == nil && string(data) == "hi", t, "read %q %v", data, err)
+	}
+	assert(len(used) > 1, t, "shards used %v", used)
+}
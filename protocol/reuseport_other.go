@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package suft
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(network, addr string, n int) ([]net.PacketConn, error) {
+	return nil, errors.New("sharding requires SO_REUSEPORT of linux")
+}
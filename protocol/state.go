@@ -1,8 +1,10 @@
 package suft
 
 import (
+	"context"
 	"errors"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -15,15 +17,21 @@ const (
 )
 
 const (
-	_FIN_ACK_SEQ uint32 = 0xffFF0000
 	_INVALID_SEQ uint32 = 0xffFFffFF
 )
 
+// payload of FIN, the sender of FIN is still reading
+const _FIN_HALF = 1
+
+// the initial seq of connections, overridden by tests
+var initialSeq = rand.Uint32
+
 var (
 	ErrIOTimeout        error = &TimeoutError{}
 	ErrUnknown                = errors.New("Unknown error")
 	ErrInexplicableData       = errors.New("Inexplicable data")
 	ErrTooManyAttempts        = errors.New("Too many attempts to connect")
+	ErrConnRefused            = errors.New("Connection refused")
 )
 
 type TimeoutError struct{}
@@ -33,10 +41,16 @@ func (e *TimeoutError) Timeout() bool   { return true }
 func (e *TimeoutError) Temporary() bool { return true }
 
 type Conn struct {
-	sock   *net.UDPConn
-	dest   *net.UDPAddr
+	sock   net.PacketConn
+	bio    *batchIO
+	dest   atomic.Value // destAddr, changed by migration
 	edp    *Endpoint
 	connID connID // 8 bytes
+	path   pathState
+	// admission
+	inbound  bool
+	admitKey string
+	created  int64
 	// events
 	evRecv  chan []byte
 	evRead  chan byte
@@ -44,6 +58,9 @@ type Conn struct {
 	evSWnd  chan byte
 	evAck   chan byte
 	evClose chan byte
+	evKeep  chan byte
+	evPmtu  chan byte
+	evDgram chan byte
 	// protocol state
 	inlock       sync.Mutex
 	outlock      sync.Mutex
@@ -68,17 +85,44 @@ type Conn struct {
 	tSlot        int64
 	tSlotT0      int64
 	lastSErr     int64
+	lastRecv     int64
+	kaPeriod     int64
+	idleTmo      int64
+	err          atomic.Value // connErr, reason of abort
+	aborted      int32        // abort while closing, the waits give up
+	wClosed      int32 // fin-W has been started
+	rClosed      int32 // CloseRead was called
+	halfW        int32 // CloseWrite was called, nobody waits for fin of peer
+	peerHalf     int32 // peer called CloseWrite
+	evReadClosed int32
+	ready        int32 // handshake finished, the controls are accepted
 	// queue
 	outQ        *linkedMap
 	inQ         *linkedMap
 	inQReady    []byte
 	inQDirty    bool
 	lastReadSeq uint32 // last user read seq
+	frags       map[uint32]*fragment // in internalRecvLoop
+	// positions in the stream, in inlock
+	readPos  int64   // bytes read by user
+	movedPos int64   // bytes moved into inQReady
+	msgEnds  []int64 // ends of the messages not read
 	// params
 	bandwidth      int64
 	fastRetransmit bool
 	flatTraffic    bool
-	mss            int
+	mss            int32 // atomic, grows by probing
+	pmtu           pmtuState
+	dgram          dgramState
+	rbufLimit      int
+	rcvEdge        uint32 // advertised window, in inlock
+	sndEdge        uint32 // window of peer, in outlock
+	// negotiated
+	maxMss   int
+	version  uint8
+	peerWnd  int32
+	peerRbuf int // bytes, 0 if unknown
+	features uint32
 	// statistics
 	urgent    int
 	inPkCnt   int
@@ -88,10 +132,10 @@ type Conn struct {
 	fRCnt     int
 }
 
-func NewConn(e *Endpoint, dest *net.UDPAddr, id connID) *Conn {
+func NewConn(e *Endpoint, dest net.Addr, id connID) *Conn {
 	c := &Conn{
-		sock:    e.udpconn,
-		dest:    dest,
+		sock:    e.socks[e.shardOf(id.lid)],
+		bio:     e.bio[e.shardOf(id.lid)],
 		edp:     e,
 		connID:  id,
 		evRecv:  make(chan []byte, 128),
@@ -100,24 +144,35 @@ func NewConn(e *Endpoint, dest *net.UDPAddr, id connID) *Conn {
 		evSend:  make(chan byte, 4),
 		evAck:   make(chan byte, 1),
 		evClose: make(chan byte, 2),
+		evKeep:  make(chan byte, 1),
+		evPmtu:  make(chan byte, 1),
+		evDgram: make(chan byte, 1),
 		outQ:    newLinkedMap(_QModeOut),
 		inQ:     newLinkedMap(_QModeIn),
 	}
+	c.setDest(dest)
+	c.created = Now()
 	p := e.params
+	c.mySeq = initialSeq()
+	c.path.token = randU64()
+	c.dgram.init()
 	c.bandwidth = p.Bandwidth
 	c.fastRetransmit = p.FastRetransmit
 	c.flatTraffic = p.FlatTraffic
-	c.mss = _MSS
-	if dest.IP.To4() == nil {
-		// typical ipv6 header length=40
-		c.mss -= 20
+	c.maxMss = e.maxMss(dest)
+	c.mss = int32(c.maxMss)
+	c.version = _VERSION
+	c.peerWnd = _MAX_SWND
+	c.rbufLimit = _RECV_BUFFER
+	if p.RecvBuffer > 0 {
+		c.rbufLimit = p.RecvBuffer
 	}
 	return c
 }
 
-func (c *Conn) initConnection(buf []byte) (err error) {
+func (c *Conn) initConnection(ctx context.Context, buf []byte) (err error) {
 	if buf == nil {
-		err = c.initDialing()
+		err = c.initDialing(ctx)
 	} else { //server
 		err = c.acceptConnection(buf[_TH_SIZE:])
 	}
@@ -127,6 +182,9 @@ func (c *Conn) initConnection(buf []byte) (err error) {
 	if c.state == _S_EST1 {
 		c.lastReadSeq = c.lastAck
 		c.inQ.maxCtnSeq = c.lastAck
+		// the windows of handshake
+		c.rcvEdge = c.lastAck + uint32(c.recvWindow())
+		c.sndEdge = c.mySeq + uint32(c.peerWnd)
 		c.rtt = maxI64(c.rtt, _MIN_RTT)
 		c.mdev = c.rtt << 1
 		c.srtt = c.rtt << 3
@@ -134,8 +192,10 @@ func (c *Conn) initConnection(buf []byte) (err error) {
 		c.ato = maxI64(c.rtt>>4, _MIN_ATO)
 		c.ato = minI64(c.ato, _MAX_ATO)
 		// initial cwnd
-		c.swnd = calSwnd(c.bandwidth, c.rtt) >> 1
+		c.swnd = minI32(calSwnd(c.bandwidth, c.rtt, c.mss)>>1, c.peerWnd)
 		c.cwnd = 8
+		c.lastRecv = Now()
+		atomic.StoreInt32(&c.ready, 1)
 		go c.internalRecvLoop()
 		go c.internalSendLoop()
 		go c.internalAckLoop()
@@ -148,25 +208,54 @@ func (c *Conn) initConnection(buf []byte) (err error) {
 	}
 }
 
-func (c *Conn) initDialing() error {
+func (c *Conn) initDialing(ctx context.Context) error {
 	// first syn
 	pk := &packet{
-		seq:  c.mySeq,
-		flag: _F_SYN,
+		seq:     c.mySeq,
+		flag:    _F_SYN,
+		payload: c.myHello().marshall(),
 	}
 	item := nodeOf(pk)
-	var buf []byte
-	c.state = _S_SYN0
+	var in = new(packet)
+	var cookied bool
+	atomic.StoreInt32(&c.state, _S_SYN0)
 	t0 := Now()
 	for i := 0; i < _MAX_RETRIES && c.state == _S_SYN0; i++ {
-		// send syn
+		// send syn, or syn+ack for simultaneous open
 		c.internalWrite(item)
 		select {
-		case buf = <-c.evRecv:
-			c.rtt = Now() - t0
-			c.state = _S_SYN1
+		case buf := <-c.evRecv:
+			unmarshall(in, buf[_TH_SIZE:])
+			if cookie := parseCookie(in); cookie != nil {
+				// prove we own the address, resend syn with the cookie once
+				if !cookied {
+					cookied = true
+					pk.payload = appendCookie(pk.payload, cookie)
+					item.scnt = 0
+					t0 = Now()
+				}
+				continue
+			}
+			if in.flag&_F_RESET != 0 {
+				return resetError(in.payload)
+			}
 			c.connID.setRid(buf)
-			buf = buf[_TH_SIZE:]
+			if in.flag == _F_SYN {
+				// simultaneous open: the peer is dialing us at the same time.
+				// reply syn+ack and keep waiting for the syn+ack of peer.
+				pk.ack = in.seq
+				pk.flag = _F_SYN | _F_ACK
+				item.scnt = 0
+				c.logAck(in.seq)
+				if err := c.applyHello(in.payload); err != nil {
+					return err
+				}
+				continue
+			}
+			c.rtt = Now() - t0
+			atomic.StoreInt32(&c.state, _S_SYN1)
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-time.After(time.Second):
 			continue
 		}
@@ -175,26 +264,31 @@ func (c *Conn) initDialing() error {
 		return ErrTooManyAttempts
 	}
 
-	unmarshall(pk, buf)
+	switch {
 	// expected syn+ack
-	if pk.flag == _F_SYN|_F_ACK && pk.ack == c.mySeq {
-		if scnt := pk.scnt - 1; scnt > 0 {
-			c.rtt -= int64(scnt) * 1e3
+	case in.flag == _F_SYN|_F_ACK && in.ack == c.mySeq:
+		if scnt := in.scnt - 1; scnt > 0 {
+			c.rtt -= int64(scnt) * 1e6
 		}
 		log.Println("rtt", c.rtt)
-		c.state = _S_EST0
+		if err := c.applyHello(in.payload); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&c.state, _S_EST0)
 		// build ack3
-		pk.scnt = 0
-		pk.ack = pk.seq
-		pk.flag = _F_ACK
-		item := nodeOf(pk)
+		ack3 := &packet{ack: in.seq, flag: _F_ACK}
 		// send ack3
-		c.internalWrite(item)
+		c.internalWrite(nodeOf(ack3))
 		// update lastAck
-		c.logAck(pk.ack)
-		c.state = _S_EST1
+		c.logAck(ack3.ack)
+		atomic.StoreInt32(&c.state, _S_EST1)
 		return nil
-	} else {
+	// simultaneous open: syn+ack of peer was lost but its ack3 arrived
+	case in.flag == _F_ACK && in.ack == c.mySeq && pk.flag&_F_ACK != 0:
+		log.Println("rtt", c.rtt)
+		atomic.StoreInt32(&c.state, _S_EST1)
+		return nil
+	default:
 		return ErrInexplicableData
 	}
 }
@@ -205,11 +299,15 @@ func (c *Conn) acceptConnection(buf []byte) error {
 	unmarshall(pk, buf)
 	// expected syn
 	if pk.flag == _F_SYN {
-		c.state = _S_SYN1
+		atomic.StoreInt32(&c.state, _S_SYN1)
+		if err := c.applyHello(pk.payload); err != nil {
+			return err
+		}
 		// build syn+ack
 		pk.ack = pk.seq
 		pk.seq = c.mySeq
 		pk.flag |= _F_ACK
+		pk.payload = c.myHello().marshall()
 		// update lastAck
 		c.logAck(pk.ack)
 		item = nodeOf(pk)
@@ -225,7 +323,7 @@ func (c *Conn) acceptConnection(buf []byte) error {
 		// recv ack3
 		select {
 		case buf = <-c.evRecv:
-			c.state = _S_EST0
+			atomic.StoreInt32(&c.state, _S_EST0)
 			c.rtt = Now() - t0
 			buf = buf[_TH_SIZE:]
 			log.Println("rtt", c.rtt)
@@ -241,13 +339,13 @@ func (c *Conn) acceptConnection(buf []byte) error {
 	unmarshall(pk, buf)
 	// expected ack3
 	if pk.flag == _F_ACK && pk.ack == c.mySeq {
-		c.state = _S_EST1
+		atomic.StoreInt32(&c.state, _S_EST1)
 	} else {
 		// if ack3 lost, resend syn+ack 3-times
 		// and drop these coming data
-		if pk.flag&_F_DATA != 0 && pk.seq > c.lastAck {
+		if pk.flag&_F_DATA != 0 && seqAfter(pk.seq, c.lastAck) {
 			c.internalWrite(item)
-			c.state = _S_EST1
+			atomic.StoreInt32(&c.state, _S_EST1)
 		} else {
 			dumpb("Ack3 ?", buf)
 			return ErrInexplicableData
@@ -273,6 +371,10 @@ func selfSpinWait(fn func() bool) error {
 	return ErrIOTimeout
 }
 
+func (c *Conn) isReady() bool {
+	return atomic.LoadInt32(&c.ready) != 0
+}
+
 func (c *Conn) IsClosed() bool {
 	return atomic.LoadInt32(&c.state) <= _S_FIN1
 }
@@ -291,14 +393,24 @@ passive close:
 */
 func (c *Conn) Close() (err error) {
 	if !atomic.CompareAndSwapInt32(&c.state, _S_EST1, _S_FIN0) {
+		if c.isPeerHalfClosed() {
+			return c.closeHalfClosed()
+		}
+		if atomic.LoadInt32(&c.halfW) != 0 {
+			// CloseWrite was called, don't wait for the fin of peer
+			c.abort(net.ErrClosed)
+		}
 		return selfSpinWait(func() bool {
 			return atomic.LoadInt32(&c.state) == _S_FIN
 		})
 	}
 	var err0 error
-	err0 = c.closeW()
+	err0 = c.closeW(false)
 	// waiting for fin-2 of peer
 	err = selfSpinWait(func() bool {
+		if c.isAborted() {
+			return true
+		}
 		select {
 		case v := <-c.evClose:
 			if v == _S_FIN {
@@ -311,7 +423,7 @@ func (c *Conn) Close() (err error) {
 		return false
 	})
 	defer c.afterShutdown()
-	if err != nil {
+	if err != nil || c.isAborted() {
 		// backup path for wait ack(finW) timeout
 		c.closeR(nil)
 	}
@@ -322,12 +434,70 @@ func (c *Conn) Close() (err error) {
 	}
 }
 
-func (c *Conn) beforeCloseW() (err error) {
+/*
+half close:
+CloseWrite sends fin-W with payload _FIN_HALF, then the peer only closes R
+and keeps sending until it calls Close or CloseWrite, and its fin finishes us.
+*/
+
+// CloseWrite shuts down the writing side, the peer will read EOF
+// and it's still able to send data to us.
+func (c *Conn) CloseWrite() error {
+	if atomic.CompareAndSwapInt32(&c.state, _S_EST1, _S_FIN0) {
+		atomic.StoreInt32(&c.halfW, 1)
+		return c.closeW(true)
+	}
+	if c.isPeerHalfClosed() {
+		return c.closeHalfClosed()
+	}
+	return net.ErrClosed
+}
+
+// CloseRead shuts down the reading side, the received data will be discarded.
+func (c *Conn) CloseRead() error {
+	if !atomic.CompareAndSwapInt32(&c.rClosed, 0, 1) {
+		return net.ErrClosed
+	}
+	c.inlock.Lock()
+	c.inQReady = nil
+	c.moveInQReady()
+	c.inlock.Unlock()
+	c.closeEvRead()
+	return nil
+}
+
+func (c *Conn) isPeerHalfClosed() bool {
+	return atomic.LoadInt32(&c.peerHalf) != 0 && atomic.LoadInt32(&c.state) == _S_FIN1
+}
+
+// R was closed by the fin-W of peer, then close W and finish.
+func (c *Conn) closeHalfClosed() (err error) {
+	if !atomic.CompareAndSwapInt32(&c.wClosed, 0, 1) {
+		return selfSpinWait(func() bool {
+			return atomic.LoadInt32(&c.state) == _S_FIN
+		})
+	}
+	err = c.closeW(false)
+	atomic.StoreInt32(&c.state, _S_FIN)
+	// stop internalAckLoop
+	c.evAck <- _CLOSE
+	c.afterShutdown()
+	return
+}
+
+func (c *Conn) closeEvRead() {
+	if atomic.CompareAndSwapInt32(&c.evReadClosed, 0, 1) {
+		close(c.evRead)
+		close(c.dgram.closed)
+	}
+}
+
+func (c *Conn) beforeCloseW(half bool) (err error) {
 	// check outQ was empty and all has been acked.
 	// self-spin waiting
 	for i := 0; i < 2; i++ {
 		err = selfSpinWait(func() bool {
-			return atomic.LoadInt32(&c.outPending) <= 0
+			return atomic.LoadInt32(&c.outPending) <= 0 || c.isAborted()
 		})
 		if err == nil {
 			break
@@ -338,6 +508,9 @@ func (c *Conn) beforeCloseW() (err error) {
 	c.mySeq++
 	c.outPending++
 	pk := &packet{seq: c.mySeq, flag: _F_FIN}
+	if half {
+		pk.payload = []byte{_FIN_HALF}
+	}
 	item := nodeOf(pk)
 	c.outQ.appendTail(item)
 	c.internalWrite(item)
@@ -346,20 +519,21 @@ func (c *Conn) beforeCloseW() (err error) {
 	return
 }
 
-func (c *Conn) closeW() (err error) {
+func (c *Conn) closeW(half bool) (err error) {
+	atomic.StoreInt32(&c.wClosed, 1)
 	// close resource of sending
 	defer c.afterCloseW()
 	// send fin
-	err = c.beforeCloseW()
+	err = c.beforeCloseW(half)
 	var closed bool
 	var max = 20
-	if c.rtt > 200 {
-		max = int(c.rtt) / 10
+	if c.rtt > 200*_MS {
+		max = int(c.rtt/_MS) / 10
 	}
 	// waiting for outQ means:
 	// 1. all outQ has been acked, for passive
 	// 2. fin has been acked, for active
-	for i := 0; i < max && (atomic.LoadInt32(&c.outPending) > 0 || !closed); i++ {
+	for i := 0; i < max && (atomic.LoadInt32(&c.outPending) > 0 || !closed) && !c.isAborted(); i++ {
 		select {
 		case v := <-c.evClose:
 			if v == _S_FIN0 {
@@ -373,6 +547,8 @@ func (c *Conn) closeW() (err error) {
 	}
 	if closed || err != nil {
 		return
+	} else if c.isAborted() {
+		return c.closeErr()
 	} else {
 		return ErrIOTimeout
 	}
@@ -394,24 +570,18 @@ func (c *Conn) afterShutdown() {
 	// stop internalRecvLoop
 	c.evRecv <- nil
 	// remove registry
-	c.edp.removeConn(c.connID, c.dest)
+	c.edp.removeConn(c.connID, c.RemoteAddr())
 	log.Println("shutdown", c.state)
 }
 
-// trigger by reset
-func (c *Conn) forceShutdownWithLock() {
-	c.outlock.Lock()
-	defer c.outlock.Unlock()
-	c.forceShutdown()
-}
-
 // called by:
 // 	1/ send exception
 //	2/ recv reset
-// drop outQ and force shutdown
-func (c *Conn) forceShutdown() {
+// drop outQ and force shutdown, must in outlock. Return true if it was
+// shut down, then stopLoops must be called after releasing outlock,
+// because the loops may be waiting for the lock.
+func (c *Conn) forceShutdown() bool {
 	if atomic.CompareAndSwapInt32(&c.state, _S_EST1, _S_FIN) {
-		defer c.afterShutdown()
 		// stop sender
 		for i := 0; i < cap(c.evSend); i++ {
 			select {
@@ -425,13 +595,44 @@ func (c *Conn) forceShutdown() {
 		}
 		c.outQ.reset()
 		// stop reader
-		close(c.evRead)
+		c.closeEvRead()
 		c.inQ.reset()
-		// stop internalLoops
-		c.evSWnd <- _CLOSE
-		c.evAck <- _CLOSE
-		//log.Println("force shutdown")
+		return true
+	}
+	return false
+}
+
+// stop internalLoops after forceShutdown
+func (c *Conn) stopLoops() {
+	c.evSWnd <- _CLOSE
+	c.evAck <- _CLOSE
+	c.afterShutdown()
+}
+
+// called by closing endpoint, reset the peer and release the resources
+// whether the connection is closing or not.
+func (c *Conn) hardReset(err error) {
+	c.outlock.Lock()
+	if dest := c.RemoteAddr(); dest != nil {
+		c.edp.resetPeer(c.edp.shardOf(c.connID.lid), dest, c.connID)
+	}
+	if atomic.LoadInt32(&c.state) == _S_EST1 {
+		c.setErr(err)
+		shut := c.forceShutdown()
+		c.outlock.Unlock()
+		if shut {
+			c.stopLoops()
+		}
+		return
 	}
+	// closing is in progress, release the blocked reader and writer
+	c.closeEvRead()
+	select {
+	case c.evSend <- _CLOSE:
+	default:
+	}
+	c.outlock.Unlock()
+	c.edp.removeConn(c.connID, c.RemoteAddr())
 }
 
 // for sending fin failed
@@ -444,6 +645,7 @@ func (c *Conn) fakeShutdown() {
 
 func (c *Conn) closeR(pk *packet) {
 	var passive = true
+	var half = pk != nil && len(pk.payload) > 0 && pk.payload[0] == _FIN_HALF
 	for {
 		state := atomic.LoadInt32(&c.state)
 		switch state {
@@ -464,9 +666,14 @@ func (c *Conn) closeR(pk *packet) {
 	// here, R is closed.
 	// ^^^^^^^^^^^^^^^^^^^^^
 	if passive {
+		if half {
+			// keep W open until Close or CloseWrite is called
+			atomic.StoreInt32(&c.peerHalf, 1)
+			return
+		}
 		// passive closing call closeW contains sending fin and recv ack
 		// may the ack of fin-2 was lost, then the closeW will timeout
-		c.closeW()
+		c.closeW(false)
 	}
 	// here, R,W both were closed.
 	// ^^^^^^^^^^^^^^^^^^^^^
@@ -474,7 +681,7 @@ func (c *Conn) closeR(pk *packet) {
 	// stop internalAckLoop
 	c.evAck <- _CLOSE
 
-	if passive {
+	if passive || atomic.LoadInt32(&c.halfW) != 0 {
 		// close evRecv within here
 		c.afterShutdown()
 	} else {
@@ -490,10 +697,10 @@ func (c *Conn) passiveCloseReply(pk *packet, first bool) {
 	if pk != nil && pk.flag&_F_FIN != 0 {
 		if first {
 			c.checkInQ(pk)
-			close(c.evRead)
+			c.closeEvRead()
 		}
-		// ack the FIN
-		pk = &packet{seq: _FIN_ACK_SEQ, ack: pk.seq, flag: _F_ACK}
+		// ack the FIN, a plain ack on its seq
+		pk = &packet{ack: pk.seq, flag: _F_ACK}
 		item := nodeOf(pk)
 		c.internalWrite(item)
 	}
@@ -508,9 +715,6 @@ func (c *Conn) checkInQ(pk *packet) {
 	}
 	c.inlock.Lock()
 	defer c.inlock.Unlock()
-	if c.inQ.size() > 0 {
-		for i := c.inQ.head; i != nil; i = i.next {
-			c.inQReady = append(c.inQReady, i.payload...)
-		}
-	}
+	// dequeue them, or the reader would copy them again
+	c.moveInQReady()
 }
@@ -1,91 +1,103 @@
 package suft
 
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// the protocol clock is in microseconds
+const _MS = 1e3
+
+// Millisecond is the nanoseconds of a millisecond.
+//
+// Deprecated: it was the unit of the former timer, the protocol clock
+// given by Now is in microseconds. Use time.Millisecond instead.
 const Millisecond = 1e6
 
+// iTimer sends to C once the duration (in us) elapsed, it isn't started
+// by newTimer. The underlying timer is allocated only once and rearmed by
+// Reset, which doesn't allocate.
+// The fire of previous arming may be running while rearming, it's told by
+// the due time of current arming, which is never reached by a stale one.
 type iTimer struct {
-	C chan byte
-	r runtimeTimer
+	C      chan byte
+	t      *time.Timer
+	lock   sync.Mutex
+	due    int64 // in ns, of current arming
+	active bool  // armed and not fired yet
 }
 
-type runtimeTimer struct {
-	i      int
-	when   int64
-	period int64
-	f      func(c interface{}, seq uintptr) // NOTE: must not be closure
-	arg    interface{}
-	seq    uintptr
-}
-
-func startTimer(*runtimeTimer)
-func stopTimer(*runtimeTimer) bool
-func runtimeNano() int64
-func currentTime() (sec int64, nsec int32)
+var clockBase = time.Now()
 
+// Now returns the protocol clock in microseconds, it's monotonic and
+// never jumps with the wall clock.
 func Now() int64 {
-	s, n := currentTime()
-	return s*1e3 + int64(n/1e6)
+	return int64(time.Since(clockBase) / time.Microsecond)
 }
 
+// NowNS is the monotonic clock in nanoseconds
 func NowNS() int64 {
-	s, n := currentTime()
-	return s*1e9 + int64(n)
+	return int64(time.Since(clockBase))
 }
 
 func newTimer(d int64) *iTimer {
-	t := iTimer{
-		C: make(chan byte, 1),
-		r: runtimeTimer{
-			i:    -1,
-			when: d*Millisecond + runtimeNano(),
-			f:    timerCallback,
-		},
-	}
-	t.r.arg = t.C
-	return &t
+	t := &iTimer{C: make(chan byte, 1), due: math.MaxInt64}
+	t.t = time.AfterFunc(time.Duration(d)*time.Microsecond, t.fire)
+	t.t.Stop()
+	return t
 }
 
-func timerCallback(c interface{}, seq uintptr) {
+func (t *iTimer) fire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if NowNS() < t.due { // stale
+		return
+	}
+	t.active = false
 	select {
-	case c.(chan byte) <- 1:
+	case t.C <- 1:
 	default:
 	}
 }
 
 func (t *iTimer) Stop() {
-	stopTimer(&t.r)
+	t.lock.Lock()
+	t.t.Stop()
+	t.due = math.MaxInt64
+	t.active = false
+	t.lock.Unlock()
 }
 
 func (t *iTimer) Reset(d int64) {
-	stopTimer(&t.r)
-	select {
-	case <-t.C:
-	default:
-	}
-	t.r.when = d*Millisecond + runtimeNano()
-	startTimer(&t.r)
+	t.lock.Lock()
+	t.reset(d)
+	t.lock.Unlock()
 }
 
 func (t *iTimer) TryActive(d int64) {
-	if t.r.i < 0 {
-		select {
-		case <-t.C:
-		default:
-		}
-		t.r.when = d*Millisecond + runtimeNano()
-		startTimer(&t.r)
+	t.lock.Lock()
+	if !t.active {
+		t.reset(d)
 	}
+	t.lock.Unlock()
 }
 
-func NewTimerChan(d int64) <-chan byte {
-	t := iTimer{
-		C: make(chan byte, 1),
-		r: runtimeTimer{
-			i:    -1,
-			when: d*Millisecond + runtimeNano(),
-			f:    timerCallback,
-		},
+// must in lock
+func (t *iTimer) reset(d int64) {
+	t.t.Stop()
+	select {
+	case <-t.C:
+	default:
 	}
-	t.r.arg = t.C
-	startTimer(&t.r)
-	return t.C
+	t.due = NowNS() + d*1e3
+	t.active = true
+	t.t.Reset(time.Duration(d) * time.Microsecond)
+}
+
+// the one-shot timer
+func NewTimerChan(d int64) <-chan byte {
+	c := make(chan byte, 1)
+	time.AfterFunc(time.Duration(d)*time.Microsecond, func() { c <- 1 })
+	return c
 }
@@ -0,0 +1,80 @@
+package suft
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_timer(t *testing.T) {
+	tm := newTimer(10 * _MS)
+	select {
+	case <-tm.C:
+		t.Fatal("started by newTimer")
+	case <-time.After(30 * time.Millisecond):
+	}
+	tm.Reset(10 * _MS)
+	select {
+	case <-tm.C:
+	case <-time.After(time.Second):
+		t.Fatal("not fired")
+	}
+	// TryActive doesn't postpone the armed timer
+	tm.Reset(20 * _MS)
+	t0 := time.Now()
+	tm.TryActive(1000 * _MS)
+	<-tm.C
+	assert(time.Since(t0) < 500*time.Millisecond, t, "postponed")
+	tm.Reset(10 * _MS)
+	tm.Stop()
+	select {
+	case <-tm.C:
+		t.Fatal("fired after stop")
+	case <-time.After(30 * time.Millisecond):
+	}
+	// the fire of previous arming runs late after rearming
+	tm.Reset(20 * _MS)
+	tm.fire()
+	select {
+	case <-tm.C:
+		t.Fatal("stale fire")
+	default:
+	}
+	tm.TryActive(1000 * _MS)
+	t0 = time.Now()
+	<-tm.C
+	assert(time.Since(t0) < 500*time.Millisecond, t, "deactivated by stale fire")
+	<-NewTimerChan(1 * _MS)
+}
+
+func Benchmark_timer_reset(b *testing.B) {
+	tm := newTimer(0)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tm.Reset(1000 * _MS)
+	}
+	tm.Stop()
+}
+
+func Benchmark_timer_try_active(b *testing.B) {
+	tm := newTimer(0)
+	tm.Reset(1000 * _MS)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tm.TryActive(1000 * _MS)
+	}
+	tm.Stop()
+}
+
+func Benchmark_timer_chan(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewTimerChan(1000 * _MS)
+	}
+}
+
+func Benchmark_now(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Now()
+	}
+}
@@ -0,0 +1,26 @@
+package suft
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// Unixgram transport
+//
+// The peers are addressed by socket path, everything above the socket is
+// the same as udp. The dialer must be bound to a path too for receiving
+// the replies, so a temporary one is used if LocalAddr is empty. The
+// socket file is removed when the Endpoint is closed.
+
+func tempSockPath() string {
+	name := fmt.Sprintf("suft-%d-%08x.sock", os.Getpid(), rand.Uint32())
+	return filepath.Join(os.TempDir(), name)
+}
+
+func removeSockPath(path string) {
+	if path != "" && path[0] != '@' { // not abstract
+		os.Remove(path)
+	}
+}